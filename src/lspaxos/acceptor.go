@@ -2,9 +2,16 @@ package lspaxos
 
 import (
 	"log"
-	"net"
-	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	// Name of the acceptor's log inside its data directory
+	acceptorLogName = "acceptor.log"
 )
 
 // Defines an the Acceptor state
@@ -14,14 +21,34 @@ type Acceptor struct {
 	// Unique identifier of the acceptor
 	acceptorID int
 
+	// Mutex to synchronize access to the fields below
+	mu sync.Mutex
+
 	// Highest ballot number promised by this acceptor
 	ballot Ballot
 
 	// Map to store slot number with commands
 	acceptedValues map[int]Command
 
-	// Listener
-	listener net.Listener
+	// Every replica has applied the slots below this one, so the
+	// acceptor no longer keeps or accepts values for them
+	compactedSlot int
+
+	// Address of the leader that holds the lease of the acceptor. Until
+	// it expires the acceptor refuses the ballots of other leaders, so
+	// they don't preempt a leader that is doing fine. Not persisted: a
+	// restarted acceptor grants the lease anew.
+	leaseHolder string
+
+	// When the lease expires, by the acceptor's clock
+	leaseExpiry time.Time
+
+	// Durable log of promises and accepts, nil if the acceptor
+	// was started without a data directory
+	wal *writeAheadLog
+
+	// Carries the RPCs of the acceptor
+	transport Transport
 
 	// Address
 	Address string
@@ -30,12 +57,63 @@ type Acceptor struct {
 	dead int32
 }
 
+// Record written to the acceptor's log before it replies to a leader.
+// A promise only carries the ballot, an accept also carries the slot
+// and the command that was accepted. A compacted record carries the slot
+// below which everything was garbage collected.
+type acceptorRecord struct {
+	Ballot Ballot
+
+	Accepted bool
+
+	Compacted bool
+
+	Slot int
+
+	Command Command
+}
+
+// Persists a record if the acceptor has a log
+func (thisAcceptor *Acceptor) persist(record acceptorRecord) (err error) {
+	if thisAcceptor.wal == nil {
+		return nil
+	}
+	return thisAcceptor.wal.append(record)
+}
+
+// Applies a record to the in-memory state
+func (thisAcceptor *Acceptor) apply(record acceptorRecord) {
+	thisAcceptor.ballot = record.Ballot
+	if record.Accepted {
+		thisAcceptor.acceptedValues[record.Slot] = record.Command
+	}
+	if record.Compacted {
+		thisAcceptor.compactedSlot = record.Slot
+	}
+}
+
 // Handler for Scout RPC's
 // Checks if ballot number is higher and updates if necessary
 func (thisAcceptor *Acceptor) ExecutePropose(req ScoutRequest, res *ScoutResponse) (err error) {
 	log.Printf("Acceptor %d got a propose request %+v\n", thisAcceptor.acceptorID, req)
+	thisAcceptor.mu.Lock()
+	defer thisAcceptor.mu.Unlock()
+	if req.Leader != thisAcceptor.leaseHolder && time.Now().Before(thisAcceptor.leaseExpiry) {
+		log.Printf("Acceptor %d refused ballot %+v, leased to %s\n", thisAcceptor.acceptorID, req.Ballot, thisAcceptor.leaseHolder)
+		res.Ballot = thisAcceptor.ballot
+		res.AcceptorID = thisAcceptor.acceptorID
+		res.Address = req.Address
+		res.LeaseHolder = thisAcceptor.leaseHolder
+		return nil
+	}
 	if req.Ballot.Compare(thisAcceptor.ballot) > 0 {
-		thisAcceptor.ballot = req.Ballot
+		// The promise has to be durable before anybody hears about it
+		record := acceptorRecord{Ballot: req.Ballot}
+		if err = thisAcceptor.persist(record); err != nil {
+			log.Printf("Acceptor %d failed to persist promise %+v, %s\n", thisAcceptor.acceptorID, req.Ballot, err)
+			return err
+		}
+		thisAcceptor.apply(record)
 		log.Printf(
 			"Acceptor %d updated ballot %+v, accepted: %+v\n",
 			thisAcceptor.acceptorID,
@@ -43,10 +121,20 @@ func (thisAcceptor *Acceptor) ExecutePropose(req ScoutRequest, res *ScoutRespons
 			thisAcceptor.acceptedValues,
 		)
 	}
+	if req.Ballot.Compare(thisAcceptor.ballot) == 0 {
+		thisAcceptor.leaseHolder = req.Leader
+		thisAcceptor.leaseExpiry = time.Now().Add(leaderLeaseMillis * time.Millisecond)
+	}
 
 	res.Ballot = thisAcceptor.ballot
-	res.AcceptedValues = thisAcceptor.acceptedValues
+	res.AcceptedValues = make(map[int]Command)
+	for slot, command := range thisAcceptor.acceptedValues {
+		if slot >= req.Slot {
+			res.AcceptedValues[slot] = command
+		}
+	}
 	res.AcceptorID = thisAcceptor.acceptorID
+	res.Address = req.Address
 	return nil
 }
 
@@ -55,9 +143,27 @@ func (thisAcceptor *Acceptor) ExecutePropose(req ScoutRequest, res *ScoutRespons
 // to the ballot promised by the acceptor (i.e. The Commander is the leader)
 func (thisAcceptor *Acceptor) ExecuteAccept(req CommanderRequest, res *CommanderResponse) (err error) {
 	log.Printf("Acceptor %d got an accept request %+v\n", thisAcceptor.acceptorID, req)
+	thisAcceptor.mu.Lock()
+	defer thisAcceptor.mu.Unlock()
+	if req.Slot < thisAcceptor.compactedSlot {
+		// Every replica already knows the decision for this slot
+		res.Err = ErrCompacted
+		res.AcceptorID = thisAcceptor.acceptorID
+		res.Address = req.Address
+		return nil
+	}
 	if req.Ballot.Compare(thisAcceptor.ballot) >= 0 {
-		thisAcceptor.ballot = req.Ballot
-		thisAcceptor.acceptedValues[req.Slot] = req.Command
+		record := acceptorRecord{
+			Ballot:   req.Ballot,
+			Accepted: true,
+			Slot:     req.Slot,
+			Command:  req.Command,
+		}
+		if err = thisAcceptor.persist(record); err != nil {
+			log.Printf("Acceptor %d failed to persist accept %+v, %s\n", thisAcceptor.acceptorID, req, err)
+			return err
+		}
+		thisAcceptor.apply(record)
 		log.Printf(
 			"Acceptor %d accepted ballot:%+v slot:%d command:%+v \n",
 			thisAcceptor.acceptorID,
@@ -69,13 +175,86 @@ func (thisAcceptor *Acceptor) ExecuteAccept(req CommanderRequest, res *Commander
 
 	res.Ballot = thisAcceptor.ballot
 	res.AcceptorID = thisAcceptor.acceptorID
+	res.Address = req.Address
+	res.Err = OK
+	return nil
+}
+
+// Handler for lease renewals from the active leader
+// Only renews the lease of the leader whose ballot the acceptor adopted
+func (thisAcceptor *Acceptor) ExecuteRenewLease(req LeaseRequest, res *LeaseResponse) (err error) {
+	thisAcceptor.mu.Lock()
+	defer thisAcceptor.mu.Unlock()
+	if req.Ballot.Compare(thisAcceptor.ballot) == 0 {
+		thisAcceptor.leaseHolder = req.Leader
+		thisAcceptor.leaseExpiry = time.Now().Add(leaderLeaseMillis * time.Millisecond)
+	}
+	res.Ballot = thisAcceptor.ballot
+	res.Address = req.Address
 	return nil
 }
 
+// Handler for read index requests from replicas
+// Every slot decided so far was accepted by a majority of the acceptors,
+// so the highest slot any majority accepted a value in is at least as
+// high as every decided slot
+func (thisAcceptor *Acceptor) ExecuteReadIndex(req ReadIndexRequest, res *ReadIndexResponse) (err error) {
+	thisAcceptor.mu.Lock()
+	defer thisAcceptor.mu.Unlock()
+	res.Address = req.Address
+	res.Slot = thisAcceptor.compactedSlot - 1
+	for slot := range thisAcceptor.acceptedValues {
+		if slot > res.Slot {
+			res.Slot = slot
+		}
+	}
+	return nil
+}
+
+// Handler for compaction requests forwarded by leaders
+// Forgets the values accepted for every slot below the requested one
+func (thisAcceptor *Acceptor) ExecuteCompact(req CompactRequest, res *CompactResponse) (err error) {
+	thisAcceptor.mu.Lock()
+	defer thisAcceptor.mu.Unlock()
+	if req.Slot <= thisAcceptor.compactedSlot {
+		return nil
+	}
+	log.Printf("Acceptor %d compacting slots below %d\n", thisAcceptor.acceptorID, req.Slot)
+	for slot := range thisAcceptor.acceptedValues {
+		if slot < req.Slot {
+			delete(thisAcceptor.acceptedValues, slot)
+		}
+	}
+	thisAcceptor.compactedSlot = req.Slot
+	if thisAcceptor.wal == nil {
+		return nil
+	}
+
+	// Rewrite the log with just enough records to rebuild the current state
+	records := []interface{}{
+		acceptorRecord{Ballot: thisAcceptor.ballot, Compacted: true, Slot: thisAcceptor.compactedSlot},
+	}
+	for slot, command := range thisAcceptor.acceptedValues {
+		records = append(records, acceptorRecord{
+			Ballot:   thisAcceptor.ballot,
+			Accepted: true,
+			Slot:     slot,
+			Command:  command,
+		})
+	}
+	if err = thisAcceptor.wal.rewrite(records); err != nil {
+		log.Printf("Acceptor %d failed to compact its log, %s\n", thisAcceptor.acceptorID, err)
+	}
+	return err
+}
+
 func (thisAcceptor *Acceptor) kill() {
 	atomic.StoreInt32(&thisAcceptor.dead, 1)
-	if thisAcceptor.listener != nil {
-		thisAcceptor.listener.Close()
+	if thisAcceptor.Address != "" {
+		thisAcceptor.transport.Close(thisAcceptor.Address)
+	}
+	if thisAcceptor.wal != nil {
+		thisAcceptor.wal.close()
 	}
 	log.Printf("Killed acceptor %d\n", thisAcceptor.acceptorID)
 }
@@ -84,11 +263,58 @@ func (thisAcceptor *Acceptor) isDead() bool {
 	return atomic.LoadInt32(&thisAcceptor.dead) != 0
 }
 
+// Opens the acceptor's log in DataDir and replays it to restore the
+// ballot and the accepted values from before a restart
+func (thisAcceptor *Acceptor) recover(DataDir string) (err error) {
+	if err = os.MkdirAll(DataDir, 0755); err != nil {
+		return err
+	}
+	thisAcceptor.wal, err = openWriteAheadLog(filepath.Join(DataDir, acceptorLogName))
+	if err != nil {
+		return err
+	}
+	return thisAcceptor.wal.replay(func(data []byte) error {
+		var record acceptorRecord
+		if err := decodeRecord(data, &record); err != nil {
+			return err
+		}
+		thisAcceptor.apply(record)
+		return nil
+	})
+}
+
 //StartAcceptor starts an acceptor instance and returns an Acceptor struct.
 //The struct can be used to kill this instance.
-func StartAcceptor(AcceptorID int, Address string) (acceptor *Acceptor) {
-	server := rpc.NewServer()
-	listener, err := net.Listen("tcp", Address)
+//Promises and accepts are logged to DataDir before the acceptor replies,
+//and an acceptor restarted on the same DataDir comes back with the same
+//state. An empty DataDir keeps the state in memory only.
+func StartAcceptor(AcceptorID int, Address string, DataDir string, Transport Transport) (acceptor *Acceptor) {
+	acceptor = &Acceptor{
+		acceptorID:     AcceptorID,
+		ballot:         Ballot{-1, -1},
+		acceptedValues: make(map[int]Command),
+		dead:           0,
+	}
+	if DataDir != "" {
+		if err := acceptor.recover(DataDir); err != nil {
+			log.Fatalf(
+				"Acceptor %d failed to recover from %s, %s\n",
+				AcceptorID,
+				DataDir,
+				err,
+			)
+			return nil
+		}
+		log.Printf(
+			"Acceptor %d recovered ballot %+v, accepted: %+v\n",
+			AcceptorID,
+			acceptor.ballot,
+			acceptor.acceptedValues,
+		)
+	}
+
+	acceptor.transport = Transport
+	address, err := Transport.Serve(Address, acceptor)
 	if err != nil {
 		log.Fatalf(
 			"Acceptor %d failed to set up listening address %s, %s\n",
@@ -98,25 +324,6 @@ func StartAcceptor(AcceptorID int, Address string) (acceptor *Acceptor) {
 		)
 		return nil
 	}
-	acceptor = &Acceptor{
-		acceptorID:     AcceptorID,
-		ballot:         Ballot{-1, -1},
-		acceptedValues: make(map[int]Command),
-		listener:       listener,
-		dead:           0,
-		Address:        listener.Addr().String(),
-	}
-	server.Register(acceptor)
-
-	go func() {
-		for !acceptor.isDead() {
-			connection, err := acceptor.listener.Accept()
-			if err == nil {
-				go server.ServeConn(connection)
-			} else if err != nil && !acceptor.isDead() {
-				log.Fatalf("Acceptor %d failed to accept connection, %s\n", AcceptorID, err)
-			}
-		}
-	}()
+	acceptor.Address = address
 	return acceptor
 }
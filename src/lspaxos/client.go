@@ -2,29 +2,54 @@ package lspaxos
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	additiveIncrease       = 500
-	multiplicativeDecrease = 2
+	// Number of keep alives a client sends per session TTL
+	keepAlivesPerTTL = 3
+
+	// How long a replica holds a watch request when nothing happens
+	watchTimeoutMillis = 5000
+
+	// How long a watch waits before trying the next replica after
+	// failing to reach one
+	watchRetryMillis = 100
 )
 
 type Client struct {
+	// Mutex to send one command at a time, guards msgID and session
+	mu sync.Mutex
+
+	// Mutex to send one keep alive at a time, guards keepAliveMsgID.
+	// Keep alives are sent while a command waits, e.g. for a lock.
+	keepAliveMu sync.Mutex
+
+	// Mutex to guard replicas, which keep alives, watches and queries
+	// read while a command waits
+	replicasMu sync.Mutex
+
 	// Unique identifier of the client
 	clientID int
 
-	// Initial request sequence number / message id number
-	// Should start at 0
+	// Message id of the next request, see firstMsgID
 	msgID int
 
+	// Message id of the next keep alive
+	keepAliveMsgID int
+
 	// Addresses of the replica servers
 	replicas []string
 
+	// Carries the requests to the replicas
+	transport Transport
+
 	// Current time out
 	timeoutMillis int
 
@@ -33,6 +58,10 @@ type Client struct {
 
 	// Value timeout to be divided by in multiplicative decrease
 	timeoutMillisMultDec int
+
+	// Closed to stop sending keep alives for the current session, nil
+	// if the client has no session
+	session chan bool
 }
 
 // Starts a client that issues requests in the order
@@ -41,23 +70,28 @@ func StartClientWithSpec(
 	ClientID int,
 	Replicas []string,
 	Spec []string,
+	Transport Transport,
 ) (err error) {
 	thisClient := Client{
-		clientID:      ClientID,
-		msgID:         1,
-		replicas:      Replicas,
-		timeoutMillis: 0,
+		clientID:  ClientID,
+		msgID:     firstMsgID(),
+		replicas:  Replicas,
+		transport: Transport,
 	}
 	done := make(chan interface{}, len(Spec))
 	for _, line := range Spec {
 		parts := strings.Fields(line)
-		command := Command{LockName: parts[1],
-			LockOp:   LockOp(parts[0]),
-			MsgID:    thisClient.msgID,
-			ClientID: thisClient.clientID}
+		// Locks wait in line on the replicas until they are granted
+		lockOp := LockOp(parts[0])
+		command := thisClient.lockCommand(LockCommand{
+			LockName: parts[1],
+			LockOp:   lockOp,
+			Wait:     lockOp == Lock || lockOp == RLock,
+		})
+		command.MsgID = thisClient.msgID
 
 		// Send the command to each replica
-		thisClient.SendCommand(command, done)
+		thisClient.SendCommand(context.Background(), command, done)
 
 		// Grab responses, break on the first valid one.
 		for {
@@ -73,29 +107,12 @@ func StartClientWithSpec(
 				continue
 			}
 
-			switch resp.Err {
-			case ErrLockHeld:
-				// Add constant amount to timeout
-				// Wait, then resend commands
-				// Have to increment the message id to deal with stale responses
-				log.Printf("Client %d requested a held lock\n", thisClient.clientID)
-				thisClient.timeoutMillis += additiveIncrease
-				time.Sleep(time.Duration(thisClient.timeoutMillis) * time.Millisecond)
-				log.Printf("Client %d woke up\n", thisClient.clientID)
-				thisClient.msgID++
-				command.MsgID = thisClient.msgID
-				thisClient.SendCommand(command, done)
-				continue
+			switch lockResult(resp.Result, resp.Err) {
 			case ErrInvalidUnlock:
 				log.Printf("Client %d issued invalid unlock request %+v\n", thisClient.clientID, command)
 			case OK:
 				log.Printf("Client %d successfully executed %+v\n", thisClient.clientID, command)
 			}
-
-			// Either way, we're here if the lock didn't exist
-			// or if the command succeeded. Need to exit and then decrease the
-			// timeout by a factor  of multiplicativeDecrease
-			thisClient.timeoutMillis /= multiplicativeDecrease
 			break
 		}
 
@@ -111,98 +128,384 @@ func StartClient(
 	TimeoutMillis int,
 	TimeoutMillisAddInc int,
 	TimeoutMillisMultDec int,
-) Client {
-	return Client{
+	Transport Transport,
+) *Client {
+	return &Client{
 		clientID:             ClientID,
-		msgID:                1,
+		msgID:                firstMsgID(),
+		keepAliveMsgID:       firstMsgID(),
 		replicas:             Replicas,
 		timeoutMillis:        TimeoutMillis,
 		timeoutMillisAddInc:  TimeoutMillisAddInc,
 		timeoutMillisMultDec: TimeoutMillisMultDec,
+		transport:            Transport,
 	}
 }
 
+// Returns the message id a client starts with. The replicas answer a
+// message id up to the last one they applied for a client from their
+// recorded result, so a client restarted with the same id must start
+// above the ids it used before. The time in nanoseconds does, unless the
+// client sent a request every nanosecond before it restarted.
+func firstMsgID() int {
+	return int(time.Now().UnixNano())
+}
+
+// Returns the client id a client sends its keep alives under. They have
+// message ids and results of their own on the replicas, so that a keep
+// alive does not supersede the command the client is waiting on.
+func keepAliveClientID(ClientID int) int {
+	return keepAliveClientIDs - ClientID
+}
+
+// Returns the addresses of the replicas the client sends requests to
+func (thisClient *Client) currentReplicas() []string {
+	thisClient.replicasMu.Lock()
+	defer thisClient.replicasMu.Unlock()
+	return thisClient.replicas
+}
+
+// Builds the command for a lock server operation of this client. Its
+// message id is assigned when it is sent.
+func (thisClient *Client) lockCommand(lockCommand LockCommand) Command {
+	lockCommand.ClientID = thisClient.clientID
+	return encodeLockCommand(0, lockCommand)
+}
+
+// Returns the error of a lock operation, either from the replica or
+// the one the lock server returned
+func lockResult(result []byte, err Err) Err {
+	return decodeLockResult(result, err).Err
+}
+
 func (thisClient *Client) TryLock(LockName string) Err {
-	command := Command{
-		LockName: LockName,
-		LockOp:   Lock,
-		MsgID:    thisClient.msgID,
-		ClientID: thisClient.clientID,
+	_, err := thisClient.TryLockFenced(LockName)
+	return err
+}
+
+// Like TryLock, but also returns the fencing token of the grant on
+// success. The token is the same if the client already held the lock.
+func (thisClient *Client) TryLockFenced(LockName string) (token int64, err Err) {
+	command := thisClient.lockCommand(LockCommand{LockName: LockName, LockOp: Lock})
+	result := decodeLockResult(thisClient.sendAndWaitForResponse(command))
+	return result.Token, result.Err
+}
+
+// Waits until the lock is granted, and returns its fencing token.
+// The replicas queue the client behind the clients that asked for the
+// lock before it, and answer once the lock is granted to it.
+func (thisClient *Client) Lock(LockName string) (token int64) {
+	return thisClient.waitForLock(LockCommand{LockName: LockName, LockOp: Lock})
+}
+
+// Like TryLock, but the lock is released by itself after TTL unless the
+// client locks it again in the meantime, which renews the lease
+func (thisClient *Client) TryLockFor(LockName string, TTL time.Duration) Err {
+	command := thisClient.lockCommand(LockCommand{
+		LockName:  LockName,
+		LockOp:    Lock,
+		TTLMillis: int64(TTL / time.Millisecond),
+	})
+	return lockResult(thisClient.sendAndWaitForResponse(command))
+}
+
+// Like Lock, but the lock is released by itself after TTL
+func (thisClient *Client) LockFor(LockName string, TTL time.Duration) {
+	thisClient.waitForLock(LockCommand{
+		LockName:  LockName,
+		LockOp:    Lock,
+		TTLMillis: int64(TTL / time.Millisecond),
+	})
+}
+
+// Like TryLock, but also locks every lock under the given one, which
+// fails if another client holds any of them. While the client holds the
+// lock, no other client can lock the locks under it.
+func (thisClient *Client) TryLockTree(LockName string) Err {
+	command := thisClient.lockCommand(LockCommand{LockName: LockName, LockOp: Lock, Tree: true})
+	return lockResult(thisClient.sendAndWaitForResponse(command))
+}
+
+// Like Lock, but also locks every lock under the given one
+func (thisClient *Client) LockTree(LockName string) (token int64) {
+	return thisClient.waitForLock(LockCommand{LockName: LockName, LockOp: Lock, Tree: true})
+}
+
+// Returns who holds the locks under a prefix such as /svc/db, and the
+// prefix itself, sorted by lock name
+func (thisClient *Client) ListLocks(Prefix string) (holders []LockHolder, err Err) {
+	command := thisClient.lockCommand(LockCommand{LockName: Prefix, LockOp: List})
+	result := decodeLockResult(thisClient.sendAndWaitForResponse(command))
+	return result.Holders, result.Err
+}
+
+// Like ListLocks, but answered by a replica without deciding a slot.
+// The answer is as up to date as that of ListLocks.
+func (thisClient *Client) QueryLocks(Prefix string) (holders []LockHolder, err Err) {
+	query, encodeErr := encodeRecord(LockCommand{LockName: Prefix, LockOp: List})
+	if encodeErr != nil {
+		log.Fatalf("Failed to encode query of %s, %s\n", Prefix, encodeErr)
 	}
-	return thisClient.sendAndWaitForResponse(command)
+	result := decodeLockResult(thisClient.Query(query))
+	return result.Holders, result.Err
+}
+
+// Waits until the lock is granted shared, and returns its fencing token.
+// Any number of clients can hold a lock shared at the same time, as long
+// as no client holds it with Lock.
+func (thisClient *Client) RLock(LockName string) (token int64) {
+	return thisClient.waitForLock(LockCommand{LockName: LockName, LockOp: RLock})
 }
 
-func (thisClient *Client) Lock(LockName string) {
-	err := thisClient.TryLock(LockName)
-	for err != OK {
+// Releases a lock held shared
+func (thisClient *Client) RUnlock(LockName string) Err {
+	return lockResult(thisClient.sendAndWaitForResponse(thisClient.lockCommand(LockCommand{LockName: LockName, LockOp: RUnlock})))
+}
+
+// Waits in line for a lock until it is granted. Only retries if the wait
+// ended without the lock, when the session of the client expired.
+func (thisClient *Client) waitForLock(lockCommand LockCommand) (token int64) {
+	lockCommand.Wait = true
+	command := thisClient.lockCommand(lockCommand)
+	result := decodeLockResult(thisClient.sendAndWaitForResponse(command))
+	for result.Err != OK {
+		log.Printf("Client %d failed to wait for lock %s, %s\n", thisClient.clientID, lockCommand.LockName, result.Err)
 		time.Sleep(time.Duration(thisClient.timeoutMillis) * time.Millisecond)
-		thisClient.timeoutMillis += thisClient.timeoutMillisAddInc
-		err = thisClient.TryLock(LockName)
+		result = decodeLockResult(thisClient.sendAndWaitForResponse(command))
 	}
-	thisClient.timeoutMillis /= thisClient.timeoutMillisMultDec
+	return result.Token
 }
 
 func (thisClient *Client) Unlock(LockName string) Err {
+	return lockResult(thisClient.sendAndWaitForResponse(thisClient.lockCommand(LockCommand{LockName: LockName, LockOp: Unlock})))
+}
+
+func (thisClient *Client) ChanneledLock(LockName string, errChan chan Err) {
+	errChan <- thisClient.TryLock(LockName)
+}
+
+func (thisClient *Client) ChanneledUnlock(LockName string, errChan chan Err) {
+	errChan <- thisClient.Unlock(LockName)
+}
+
+// Sends the events of the locks under Prefix (acquired, released or
+// expired) to Events in the order the replicas applied them, until Stop
+// is closed. Watches one replica at a time, and moves on to the next one
+// if it fails. If a replica no longer has the events the client missed,
+// an event of kind EventsLost is sent and the watch goes on from there.
+func (thisClient *Client) Watch(Prefix string, Events chan Event, Stop chan bool) {
+	replicas := thisClient.currentReplicas()
+	afterSlot := -1
+	for replica := 0; ; {
+		request := WatchRequest{Prefix: Prefix, AfterSlot: afterSlot, TimeoutMillis: watchTimeoutMillis}
+		response := new(WatchResponse)
+		done := make(chan interface{}, 1)
+		// Stopping the watch abandons the request, and so does a replica
+		// that takes much longer than asked to answer
+		ctx, cancel := context.WithTimeout(context.Background(), (watchTimeoutMillis+rpcTimeoutMillis)*time.Millisecond)
+		go CallContext(ctx, thisClient.transport, replicas[replica%len(replicas)], "Replica.Watch", request, response, done)
+		select {
+		case <-Stop:
+			cancel()
+			return
+		case reply := <-done:
+			cancel()
+			if reply == false {
+				replica++
+				time.Sleep(watchRetryMillis * time.Millisecond)
+				continue
+			}
+		}
+		events := response.Events
+		if response.Err == ErrCompacted {
+			events = []Event{{Slot: response.Slot, Kind: EventsLost}}
+		}
+		for _, event := range events {
+			select {
+			case <-Stop:
+				return
+			case Events <- event:
+			}
+		}
+		// A replica that lags behind answers with an older slot
+		if response.Slot > afterSlot {
+			afterSlot = response.Slot
+		}
+	}
+}
+
+// Has the replicas apply an operation to their state machine, and returns
+// what the state machine returned
+func (thisClient *Client) Execute(Op []byte) (result []byte, err Err) {
 	command := Command{
-		LockName: LockName,
-		LockOp:   Unlock,
-		MsgID:    thisClient.msgID,
+		Kind:     Operation,
+		Op:       Op,
 		ClientID: thisClient.clientID,
 	}
 	return thisClient.sendAndWaitForResponse(command)
 }
 
-func (thisClient *Client) ChanneledLock(LockName string, errChan chan Err) {
-	command := Command{
-		LockName: LockName,
-		LockOp:   Lock,
-		MsgID:    thisClient.msgID,
-		ClientID: thisClient.clientID,
+// Has a replica answer a read-only query from its state machine, without
+// deciding a slot. Sent to every replica, the first answer wins.
+func (thisClient *Client) Query(Query []byte) (result []byte, err Err) {
+	replicas := thisClient.currentReplicas()
+	done := make(chan interface{}, len(replicas))
+	// The other replicas are not waited for once one answered
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, server := range replicas {
+		response := new(QueryResponse)
+		go CallContext(ctx, thisClient.transport, server, "Replica.Query", QueryRequest{Query: Query}, response, done)
+	}
+	err = ErrConnectionError
+	for range replicas {
+		response := <-done
+		if response == false {
+			continue
+		}
+		queryResponse := response.(*QueryResponse)
+		if queryResponse.Err == OK {
+			return queryResponse.Result, OK
+		}
+		err = queryResponse.Err
 	}
-	errChan <- thisClient.sendAndWaitForResponse(command)
+	return nil, err
 }
 
-func (thisClient *Client) ChanneledUnlock(LockName string, errChan chan Err) {
+// Replaces the acceptors, leaders and replicas of the cluster.
+// The new configuration is in force a few slots after the one the
+// command is decided in.
+func (thisClient *Client) Reconfigure(Config Configuration) Err {
 	command := Command{
-		LockName: LockName,
-		LockOp:   Unlock,
-		MsgID:    thisClient.msgID,
+		Kind:     Reconfigure,
 		ClientID: thisClient.clientID,
+		Config:   &Config,
+	}
+	_, err := thisClient.sendAndWaitForResponse(command)
+	return err
+}
+
+// Opens a session that lasts TTL past the last keep alive of the client.
+// A background goroutine keeps it alive until EndSession. If the client
+// crashes, the session expires and every lock the client holds is
+// released.
+func (thisClient *Client) StartSession(TTL time.Duration) Err {
+	err := lockResult(thisClient.sendAndWaitForResponse(thisClient.sessionCommand(OpenSession, TTL)))
+	if err != OK {
+		return err
+	}
+	thisClient.mu.Lock()
+	if thisClient.session != nil {
+		close(thisClient.session)
+	}
+	thisClient.session = make(chan bool)
+	go thisClient.keepAlive(TTL, thisClient.session)
+	thisClient.mu.Unlock()
+	return OK
+}
+
+// Closes the session, releasing the locks the client holds
+func (thisClient *Client) EndSession() Err {
+	thisClient.mu.Lock()
+	if thisClient.session != nil {
+		close(thisClient.session)
+		thisClient.session = nil
 	}
-	errChan <- thisClient.sendAndWaitForResponse(command)
+	thisClient.mu.Unlock()
+	return lockResult(thisClient.sendAndWaitForResponse(thisClient.sessionCommand(CloseSession, 0)))
+}
+
+// Builds the command for a session operation of this client
+func (thisClient *Client) sessionCommand(LockOp LockOp, TTL time.Duration) Command {
+	return thisClient.lockCommand(LockCommand{
+		LockOp:    LockOp,
+		TTLMillis: int64(TTL / time.Millisecond),
+	})
 }
 
-func (thisClient *Client) sendAndWaitForResponse(command Command) Err {
-	// Send the command to each replica
+// Sends keep alives for a session until it is closed or expired
+func (thisClient *Client) keepAlive(TTL time.Duration, session chan bool) {
+	for {
+		select {
+		case <-session:
+			return
+		case <-time.After(TTL / keepAlivesPerTTL):
+		}
+		err := lockResult(thisClient.sendKeepAlive(thisClient.sessionCommand(KeepAlive, TTL)))
+		if err == ErrSessionExpired {
+			log.Printf("Client %d session expired\n", thisClient.clientID)
+			return
+		}
+	}
+}
+
+func (thisClient *Client) sendAndWaitForResponse(command Command) (result []byte, err Err) {
+	// Commands are sent one at a time, and get their message id here so
+	// that message ids follow the order the commands are sent in
+	thisClient.mu.Lock()
+	defer thisClient.mu.Unlock()
+	command.MsgID = thisClient.msgID
 	defer func() { thisClient.msgID++ }()
-	done := make(chan interface{})
+	return thisClient.send(command)
+}
+
+// Sends a keep alive without waiting for the command being sent, which
+// may block for as long as the client waits for a lock
+func (thisClient *Client) sendKeepAlive(command Command) (result []byte, err Err) {
+	thisClient.keepAliveMu.Lock()
+	defer thisClient.keepAliveMu.Unlock()
+	command.ClientID = keepAliveClientID(thisClient.clientID)
+	command.MsgID = thisClient.keepAliveMsgID
+	defer func() { thisClient.keepAliveMsgID++ }()
+	return thisClient.send(command)
+}
+
+// Sends a command with its message id to each replica, and returns the
+// first response to it
+func (thisClient *Client) send(command Command) (result []byte, err Err) {
+	replicas := thisClient.currentReplicas()
+	done := make(chan interface{}, len(replicas))
 	var responseCount = 0
-	thisClient.SendCommand(command, done)
+	// The other replicas are not waited for once one answered
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	thisClient.sendCommand(ctx, replicas, command, done)
 	for {
 		response := <-done
 		responseCount++
 		if response == false {
-			if responseCount < len(thisClient.replicas) {
+			if responseCount < len(replicas) {
 				log.Printf("Client %d connection error\n", thisClient.clientID)
 				continue
 			} else {
-				return ErrConnectionError
+				return nil, ErrConnectionError
 			}
 		}
 		clientResponse := response.(*ClientResponse)
-		if clientResponse.MsgID == thisClient.msgID {
-			return clientResponse.Err
+		if clientResponse.MsgID == command.MsgID {
+			if len(clientResponse.Replicas) > 0 {
+				// Follow the replicas through reconfigurations
+				thisClient.replicasMu.Lock()
+				thisClient.replicas = clientResponse.Replicas
+				thisClient.replicasMu.Unlock()
+			}
+			return clientResponse.Result, clientResponse.Err
 		}
 	}
 }
 
-// Send a command to every replica asynchronously
-func (thisClient *Client) SendCommand(Command Command, Done chan interface{}) {
+// Send a command to every replica asynchronously, until Ctx is done
+func (thisClient *Client) SendCommand(Ctx context.Context, Command Command, Done chan interface{}) {
+	thisClient.sendCommand(Ctx, thisClient.currentReplicas(), Command, Done)
+}
+
+// Send a command to the given replicas asynchronously, until Ctx is done
+func (thisClient *Client) sendCommand(Ctx context.Context, Replicas []string, Command Command, Done chan interface{}) {
 	log.Printf("Client %d sent request %+v\n", thisClient.clientID, Command)
-	for _, server := range thisClient.replicas {
+	for _, server := range Replicas {
 		request := ClientRequest{Command: Command}
 		response := new(ClientResponse)
-		go Call(server, "Replica.ExecuteRequest", request, response, Done)
+		go CallWithRetries(Ctx, thisClient.transport, server, "Replica.ExecuteRequest", request, response, Done)
 	}
 }
 
@@ -1,11 +1,15 @@
 package lspaxos
 
 import (
+	"context"
 	"log"
-	"net/rpc"
+	"math/rand"
+	"time"
 )
 
 type LockOp string
+type CommandKind string
+type EventKind string
 type Err string
 
 const (
@@ -13,32 +17,129 @@ const (
 	ErrInvalidUnlock   = "Attempting to unlock unheld lock"
 	ErrLockHeld        = "Lock held by someone else"
 	ErrConnectionError = "Connection error"
+	ErrStaleRequest    = "Request superseded by a newer request from the same client"
+	ErrCompacted       = "Slot was compacted away"
+	ErrInvalidCommand  = "Command not understood by the state machine"
+	ErrNoKey           = "Key not found"
+	ErrCompareFailed   = "Value differs from the expected one"
+	ErrSessionExpired  = "Session expired"
+	ErrTimeout         = "Timed out"
+	ErrInvalidConfig   = "Configuration without acceptors, leaders or replicas"
 )
 
 const (
 	Unlock            LockOp = "Unlock"
 	Lock              LockOp = "Lock"
+	RUnlock           LockOp = "RUnlock"
+	RLock             LockOp = "RLock"
+	List              LockOp = "List"
+	OpenSession       LockOp = "OpenSession"
+	KeepAlive         LockOp = "KeepAlive"
+	CloseSession      LockOp = "CloseSession"
 	ChannelBufferSize        = 512
 )
 
+const (
+	// Operation of the state machine
+	Operation CommandKind = "Operation"
+
+	// Fills a slot without doing anything
+	Noop CommandKind = "Noop"
+
+	// Changes the configuration of the cluster
+	Reconfigure CommandKind = "Reconfigure"
+
+	// Advances the replicated clock
+	Tick CommandKind = "Tick"
+)
+
+const (
+	// A client acquired a lock
+	Acquired EventKind = "Acquired"
+
+	// A client released a lock
+	Released EventKind = "Released"
+
+	// The lease of a lock or the session of its holder expired
+	Expired EventKind = "Expired"
+
+	// The replica no longer had the events since the last ones the
+	// watch got, which may have missed some
+	EventsLost EventKind = "EventsLost"
+)
+
+const (
+	// Client Id used by the no-op commands replicas propose to fill gaps
+	noopClientID = -1
+
+	// Client Id used by the tick commands replicas propose
+	tickClientID = -2
+
+	// Client Ids the clients send their keep alives under count down
+	// from here, see keepAliveClientID
+	keepAliveClientIDs = -3
+)
+
 type Command struct {
-	// Lock name
-	LockName string
+	// Kind of command
+	Kind CommandKind
 
-	// Lock operation
-	LockOp LockOp
+	// Encoded operation, for the state machine to apply
+	Op []byte
 
 	// Message Id
 	MsgID int
 
 	// Client Id
 	ClientID int
+
+	// New configuration, for Reconfigure commands
+	Config *Configuration
+
+	// Clock of the replica that proposed it in milliseconds, for Tick
+	// commands
+	Time int64
+}
+
+// Addresses of the servers of each role that make up the cluster.
+// A configuration decided in slot s is in force from slot s+Window on,
+// where Window is that of the configuration in force at slot s.
+type Configuration struct {
+	Acceptors []string
+
+	Leaders []string
+
+	Replicas []string
+
+	// Number of slots replicas may propose in beyond the first slot
+	// they have not applied. 0 means defaultWindow.
+	Window int
+}
+
+// Tells if the configuration has servers of every role
+func (this Configuration) complete() bool {
+	return len(this.Acceptors) > 0 && len(this.Leaders) > 0 && len(this.Replicas) > 0
+}
+
+// Returns the window of the configuration
+func (this Configuration) window() int {
+	if this.Window <= 0 {
+		return defaultWindow
+	}
+	return this.Window
 }
 
 func (this Command) Equals(other Command) bool {
 	return this.ClientID == other.ClientID && this.MsgID == other.MsgID
 }
 
+// Tells if the command was sent by a client, as opposed to proposed by
+// the replicas themselves. Only those are proposed again when they lose
+// their slot.
+func (this Command) fromClient() bool {
+	return this.Kind == Operation || this.Kind == Reconfigure
+}
+
 // Number.Leader, Number takes precedence
 type Ballot struct {
 	Number int
@@ -65,6 +166,74 @@ type ClientResponse struct {
 
 	// Used to verify on the client side
 	MsgID int
+
+	// What the state machine returned for the command
+	Result []byte
+
+	// Replicas of the configuration currently in force
+	Replicas []string
+}
+
+// Client to Replica watch request/response
+
+// A client long-polls a replica for the events of the state machine.
+// The replica answers as soon as there are events in slots after
+// AfterSlot for the names under Prefix, or after TimeoutMillis without
+// any. The client then watches again after the Slot of the response.
+type WatchRequest struct {
+	// Prefix of the names to watch, like the lock names. The empty
+	// prefix watches every name.
+	Prefix string
+
+	// Last slot the client got events for, -1 to start from now
+	AfterSlot int
+
+	TimeoutMillis int
+}
+
+type WatchResponse struct {
+	// ErrCompacted if the replica dropped the events after AfterSlot
+	Err Err
+
+	// Events in slot order
+	Events []Event
+
+	// Last slot the replica applied when it responded
+	Slot int
+}
+
+// Client to Replica query request/response
+
+// A read-only query of the state machine, answered by one replica
+// without deciding a slot
+type QueryRequest struct {
+	// Encoded query, for the state machine to answer
+	Query []byte
+}
+
+type QueryResponse struct {
+	Err Err
+
+	// What the state machine answered
+	Result []byte
+}
+
+// Replica to Acceptor read index request/response
+
+// A replica asks the acceptors for the highest slot they accepted a
+// value in, to learn which slots it has to apply before it answers a
+// query.
+type ReadIndexRequest struct {
+	// Address the request was sent to
+	Address string
+}
+
+type ReadIndexResponse struct {
+	// Address the request was sent to
+	Address string
+
+	// Highest slot the acceptor accepted a value in
+	Slot int
 }
 
 // Replica-Leader request/response
@@ -77,6 +246,16 @@ type ReplicaRequest struct {
 
 	// Slot number (slot to be proposed)
 	Slot int
+
+	// First slot of the configuration the slot is decided under
+	ConfigSlot int
+
+	// Acceptors of the configuration the slot is decided under
+	Acceptors []string
+
+	// Set when a passive leader forwards the request to the leader
+	// holding the lease, which must not forward it again
+	Forwarded bool
 }
 
 // This is sent to the replica from the Commander after a slot
@@ -87,6 +266,25 @@ type ReplicaResponse struct {
 
 	// Slot number (slot that was decided)
 	Slot int
+
+	// OK, or ErrCompacted if the slot was already garbage collected
+	Err Err
+}
+
+// Replica-Leader catch up request/response
+
+// This is sent to the leader from a replica that (re)started and needs
+// to learn the slots that were decided without it.
+type CatchUpRequest struct {
+	// First slot the replica is missing
+	Slot int
+}
+
+// The leader responds with every decision it knows of, starting at the
+// requested slot.
+type CatchUpResponse struct {
+	// Decisions map (slot number to command)
+	Decisions map[int]Command
 }
 
 // Commander to Acceptor
@@ -102,6 +300,9 @@ type CommanderRequest struct {
 
 	// Ballot number
 	Ballot Ballot
+
+	// Address the request was sent to
+	Address string
 }
 
 // Response received by the Commander from the Acceptor
@@ -109,6 +310,13 @@ type CommanderResponse struct {
 	Ballot Ballot
 
 	AcceptorID int
+
+	// Address the request was sent to
+	Address string
+
+	// OK, or ErrCompacted if the acceptor garbage collected the slot,
+	// which every replica already applied
+	Err Err
 }
 
 // Scout to Acceptor
@@ -116,6 +324,16 @@ type CommanderResponse struct {
 // Scout sends a ballot number to all acceptors
 type ScoutRequest struct {
 	Ballot Ballot
+
+	// Only values accepted for this slot and above are of interest
+	Slot int
+
+	// Address of the leader, which holds the lease of the acceptor if
+	// it adopts the ballot
+	Leader string
+
+	// Address the request was sent to
+	Address string
 }
 
 // Scout gets back the highest accepted ballot number by an acceptor
@@ -126,15 +344,116 @@ type ScoutResponse struct {
 	AcceptedValues map[int]Command
 
 	AcceptorID int
+
+	// Address the request was sent to
+	Address string
+
+	// Address of the leader holding the lease of the acceptor, if the
+	// acceptor refused the ballot because of it
+	LeaseHolder string
+}
+
+// Leader to Acceptor lease renewal
+
+// The active leader regularly renews its lease at the acceptors, which
+// refuse the ballots of the other leaders while it lasts.
+type LeaseRequest struct {
+	Ballot Ballot
+
+	// Address of the leader
+	Leader string
+
+	// Address the request was sent to
+	Address string
+}
+
+type LeaseResponse struct {
+	// Ballot the acceptor has adopted
+	Ballot Ballot
+
+	// Address the request was sent to
+	Address string
+}
+
+// Leader-Leader heartbeat request/response
+
+// Passive leaders send heartbeats to the leader holding the lease, and
+// scout again once it stops answering them.
+type HeartbeatRequest struct {
+	// Address the request was sent to
+	Address string
+}
+
+type HeartbeatResponse struct {
+	// Whether the leader is still the commander
+	Active bool
+
+	Ballot Ballot
+}
+
+// Replica-Replica progress request/response
+
+// Replicas poll each other for the slot they have applied up to, to find
+// the slots every replica has applied and that can be garbage collected.
+type ProgressRequest struct {
+	// Address the request was sent to
+	Address string
+}
+
+type ProgressResponse struct {
+	// Address the request was sent to
+	Address string
+
+	// Next slot the replica has to apply
+	SlotOut int
+
+	// Set if the replica joined the cluster and waits for a snapshot
+	Joining bool
+}
+
+// Replica to Replica snapshot transfer
+
+// A healthy replica sends its state to a replica that lags behind, in
+// chunks. Data is the encoded snapshot, of which this chunk starts at
+// Offset. Done is set on the last chunk.
+type InstallSnapshotRequest struct {
+	// Replica sending the snapshot
+	ReplicaID int
+
+	// Slot the snapshot was taken at
+	SlotOut int
+
+	Offset int
+
+	Data []byte
+
+	Done bool
+}
+
+type InstallSnapshotResponse struct {
+	// Next slot the receiving replica has to apply
+	SlotOut int
+}
+
+// Replica to Leader, Leader to Acceptor
+
+// Tells leaders (and through them, acceptors) that every replica has
+// applied all slots below Slot, so they can forget about them.
+type CompactRequest struct {
+	Slot int
+}
+
+type CompactResponse struct {
 }
 
 func StartAcceptors(
 	numAcceptors int,
+	transport Transport,
 ) (acceptorAddresses []string, acceptors []*Acceptor) {
 	acceptorAddresses = make([]string, numAcceptors)
 	acceptors = make([]*Acceptor, numAcceptors)
 	for i := 0; i < numAcceptors; i++ {
-		acceptor := StartAcceptor(i, "")
+		acceptor := StartAcceptor(i, "", "", transport)
 		acceptorAddresses[i] = acceptor.Address
 		acceptors[i] = acceptor
 	}
@@ -144,11 +463,12 @@ func StartAcceptors(
 func StartLeaders(
 	numLeaders int,
 	acceptorAddresses []string,
+	transport Transport,
 ) (leaderAddresses []string, leaders []*Leader) {
 	leaderAddresses = make([]string, numLeaders)
 	leaders = make([]*Leader, numLeaders)
 	for i := 0; i < numLeaders; i++ {
-		leader := StartLeader(i, acceptorAddresses, "")
+		leader := StartLeader(i, acceptorAddresses, "", "", transport)
 		leaderAddresses[i] = leader.Address
 		leaders[i] = leader
 	}
@@ -157,54 +477,142 @@ func StartLeaders(
 
 func StartReplicas(
 	numReplicas int,
+	acceptorAddresses []string,
 	leaderAddresses []string,
+	transport Transport,
 ) (replicaAddresses []string, replicas []*Replica) {
 	replicaAddresses = make([]string, numReplicas)
 	replicas = make([]*Replica, numReplicas)
+	// Replicas need to know each other up front, so they are all served
+	// at the addresses the transport picks before any of them runs
 	for i := 0; i < numReplicas; i++ {
-		replica := StartReplica(i, leaderAddresses, "")
-		replicaAddresses[i] = replica.Address
-		replicas[i] = replica
+		replicas[i] = newReplica(i, Configuration{}, NewLockServer(), "", false, transport)
+		replicas[i].serve("")
+		replicaAddresses[i] = replicas[i].Address
+	}
+	config := Configuration{
+		Acceptors: acceptorAddresses,
+		Leaders:   leaderAddresses,
+		Replicas:  replicaAddresses,
+	}
+	for _, replica := range replicas {
+		replica.mu.Lock()
+		replica.configs[1] = config
+		replica.mu.Unlock()
+		replica.run()
 	}
 	return replicaAddresses, replicas
 }
 
-// Call is a wrapper function for creating a connection to a remote
-// server and making an RPC.
+const (
+	// How long roles wait for a peer that should answer right away (e.g.
+	// an acceptor) before giving up on it
+	rpcTimeoutMillis = 1000
+
+	// Backoff before the first retransmission of a request, doubled
+	// after every attempt up to retransmitMaxMillis
+	retransmitInitialMillis = 50
+	retransmitMaxMillis     = 800
+
+	// Number of times a request is sent before giving up on the server
+	retransmitAttempts = 5
+)
+
+// Returns a context for an RPC to a peer that should answer right away
+func rpcContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), rpcTimeoutMillis*time.Millisecond)
+}
+
+// Call is a wrapper function for making an RPC to a remote server through
+// the transport.
 // It is a blocking operation, and the caller should use a goroutine
 // to call it.
 // It sends the response in the Done channel on success, or false on
 // failure
 func Call(
+	Transport Transport,
 	ServerAddress string,
 	ProcedureName string,
 	Request interface{},
 	Response interface{},
 	Done chan interface{},
 ) {
-	client, err := rpc.Dial("tcp", ServerAddress)
-	if err != nil {
-		log.Printf(
-			"Error on Dial() Server:%s Procedure:%s, %s\n",
-			ServerAddress,
-			ProcedureName,
-			err,
-		)
+	CallContext(context.Background(), Transport, ServerAddress, ProcedureName, Request, Response, Done)
+}
+
+// CallContext is Call, except that the RPC is abandoned once Ctx is done
+// (its deadline passed, or it was canceled), in which case false is sent
+// in the Done channel without waiting for the server any longer.
+func CallContext(
+	Ctx context.Context,
+	Transport Transport,
+	ServerAddress string,
+	ProcedureName string,
+	Request interface{},
+	Response interface{},
+	Done chan interface{},
+) {
+	if callOnce(Ctx, Transport, ServerAddress, ProcedureName, Request, Response) != nil {
 		Done <- false
 		return
 	}
-	defer client.Close()
-	err = client.Call(ProcedureName, Request, Response)
+	Done <- Response
+}
+
+// CallWithRetries is CallContext, except that a request that fails is
+// sent again, up to retransmitAttempts times in all, until Ctx is done.
+// The backoff between attempts grows exponentially and is jittered, so
+// that callers that failed together don't all retransmit at once. The
+// server may get the request more than once, which every handler
+// tolerates, but Done still gets a single response.
+func CallWithRetries(
+	Ctx context.Context,
+	Transport Transport,
+	ServerAddress string,
+	ProcedureName string,
+	Request interface{},
+	Response interface{},
+	Done chan interface{},
+) {
+	backoff := retransmitInitialMillis
+	for attempt := 1; ; attempt++ {
+		if callOnce(Ctx, Transport, ServerAddress, ProcedureName, Request, Response) == nil {
+			Done <- Response
+			return
+		}
+		if attempt == retransmitAttempts {
+			Done <- false
+			return
+		}
+		select {
+		case <-Ctx.Done():
+			Done <- false
+			return
+		case <-time.After(time.Duration(backoff/2+rand.Intn(backoff/2+1)) * time.Millisecond):
+		}
+		if backoff < retransmitMaxMillis {
+			backoff *= 2
+		}
+	}
+}
+
+// Makes a single RPC, and logs why it failed if it did
+func callOnce(
+	ctx context.Context,
+	transport Transport,
+	serverAddress string,
+	procedureName string,
+	request interface{},
+	response interface{},
+) (err error) {
+	err = transport.Send(ctx, serverAddress, procedureName, request, response)
 	if err != nil {
 		log.Printf(
 			"Error on Call() Server:%s Procedure:%s Error: %s\n",
-			ServerAddress,
-			ProcedureName,
+			serverAddress,
+			procedureName,
 			err,
 		)
-		Done <- false
-		return
 	}
-
-	Done <- Response
+	return err
 }
@@ -0,0 +1,165 @@
+package lspaxos
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// Long-lived RPC connections to the servers a transport sends to, keyed
+// by address. Every role using the transport shares them, so an RPC only
+// pays for connecting the first time a server is called, or after the
+// connection to it broke.
+type connectionPool struct {
+	// Lock to control access to the clients map
+	mu sync.Mutex
+
+	// Open connection to each address
+	clients map[string]*rpc.Client
+
+	// Opens a new connection to an address
+	dial func(ctx context.Context, address string) (*rpc.Client, error)
+}
+
+func newConnectionPool(dial func(ctx context.Context, address string) (*rpc.Client, error)) *connectionPool {
+	return &connectionPool{clients: make(map[string]*rpc.Client), dial: dial}
+}
+
+// Returns the connection to the address, dialing it if there is none.
+// Tells if the connection was dialed for this call.
+func (pool *connectionPool) get(ctx context.Context, address string) (client *rpc.Client, dialed bool, err error) {
+	pool.mu.Lock()
+	client, present := pool.clients[address]
+	pool.mu.Unlock()
+	if present {
+		return client, false, nil
+	}
+
+	// Dial without the lock, so that a slow server does not hold up the
+	// calls to the others
+	client, err = pool.dial(ctx, address)
+	if err != nil {
+		return nil, false, err
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if existing, present := pool.clients[address]; present {
+		// Somebody else dialed in the meantime
+		client.Close()
+		return existing, false, nil
+	}
+	pool.clients[address] = client
+	return client, true, nil
+}
+
+// Makes an RPC over the pooled connection to the address, giving up once
+// the context is done
+func (pool *connectionPool) send(ctx context.Context, address string, procedureName string, request interface{}, response interface{}) (err error) {
+	client, dialed, err := pool.get(ctx, address)
+	if err != nil {
+		return err
+	}
+	err = call(ctx, client, procedureName, request, response)
+	if connectionFailed(err) {
+		// The connection broke. If it was an old one, the server may
+		// have closed it a while ago (e.g. because it restarted) without
+		// us noticing, so try once more on a new connection. Every
+		// handler tolerates getting the same request twice.
+		pool.discard(address, client)
+		if !dialed {
+			if client, _, err = pool.get(ctx, address); err == nil {
+				err = call(ctx, client, procedureName, request, response)
+				if connectionFailed(err) {
+					pool.discard(address, client)
+				}
+			}
+		}
+	}
+	return err
+}
+
+// Makes an RPC over the connection, and gives up on it once the context
+// is done. The connection stays usable, the late response is dropped.
+func call(ctx context.Context, client *rpc.Client, procedureName string, request interface{}, response interface{}) (err error) {
+	pending := client.Go(procedureName, request, response, make(chan *rpc.Call, 1))
+	select {
+	case <-pending.Done:
+		return pending.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Tells if an RPC failed because of its connection, rather than because
+// the handler returned an error or the caller gave up on it
+func connectionFailed(err error) bool {
+	_, isServerError := err.(rpc.ServerError)
+	return err != nil && !isServerError && err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// Closes a connection that broke, so that the next call to the address
+// dials a new one
+func (pool *connectionPool) discard(address string, client *rpc.Client) {
+	if client == nil {
+		return
+	}
+	pool.mu.Lock()
+	if pool.clients[address] == client {
+		delete(pool.clients, address)
+	}
+	pool.mu.Unlock()
+	client.Close()
+}
+
+// Connections accepted by a server. Since peers keep their connections
+// open, no longer accepting new ones is not enough to cut them off when
+// the server is closed; the connections are closed as well.
+type serverConnections struct {
+	// Lock to control access to the open map
+	mu sync.Mutex
+
+	// Connections being served
+	open map[io.Closer]bool
+
+	// Set once the server is closed, after which connections are refused
+	closed bool
+}
+
+// Calls serve, which serves RPCs on the connection until it is closed
+func (connections *serverConnections) serve(connection io.Closer, serve func()) {
+	connections.mu.Lock()
+	if connections.closed {
+		connections.mu.Unlock()
+		connection.Close()
+		return
+	}
+	if connections.open == nil {
+		connections.open = make(map[io.Closer]bool)
+	}
+	connections.open[connection] = true
+	connections.mu.Unlock()
+
+	serve()
+
+	connections.mu.Lock()
+	delete(connections.open, connection)
+	connections.mu.Unlock()
+}
+
+// Tells if the server was closed
+func (connections *serverConnections) isClosed() bool {
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	return connections.closed
+}
+
+// Closes every connection, and refuses the ones accepted from now on
+func (connections *serverConnections) close() {
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	connections.closed = true
+	for connection := range connections.open {
+		connection.Close()
+	}
+}
@@ -0,0 +1,219 @@
+package lspaxos
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC endpoint of the replicas, for the clients that don't speak Go's
+// gob. gRPC is protobuf messages over HTTP/2; net/http speaks HTTP/2
+// without TLS, which is what gRPC clients use on insecure channels, so
+// the endpoint is served by net/http. The services and messages are in
+// lspaxos.proto.
+
+const (
+	// Status codes of gRPC
+	grpcOK               = 0
+	grpcCanceled         = 1
+	grpcUnknown          = 2
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+
+	// Largest request the endpoint reads
+	grpcMaxMessageSize = 4 << 20
+)
+
+// Error of a gRPC call, with its status code
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (err grpcError) Error() string {
+	return err.message
+}
+
+// Serves the LockServer service of lspaxos.proto over gRPC at Address,
+// next to the net/rpc endpoint of a replica of a lock server. Returns the
+// address the endpoint listens on. The endpoint is closed when the
+// replica is killed. It listens on TCP rather than through the replica's
+// transport, which gRPC clients don't speak; main.go serves it with
+// -grpc-port.
+func (thisReplica *Replica) ServeGRPC(Address string) (address string, err error) {
+	// The operations of the other state machines are gob, which gRPC
+	// clients can't encode
+	if _, isLockServer := thisReplica.stateMachine.(*LockServer); !isLockServer {
+		return "", errors.New("Only replicas of a lock server serve gRPC")
+	}
+	listener, err := net.Listen("tcp", Address)
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/lspaxos.LockServer/Execute", grpcHandler(thisReplica.grpcExecuteLock))
+	mux.Handle("/", grpcHandler(func(ctx context.Context, request []byte) ([]byte, error) {
+		return nil, grpcError{grpcUnimplemented, "Unknown method"}
+	}))
+	server := &http.Server{Handler: mux, Protocols: new(http.Protocols)}
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	thisReplica.mu.Lock()
+	thisReplica.grpcServers = append(thisReplica.grpcServers, server)
+	thisReplica.mu.Unlock()
+	if thisReplica.isDead() {
+		listener.Close()
+		return "", errors.New("Replica was killed")
+	}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("Replica %d stopped serving gRPC, %s\n", thisReplica.replicaID, err)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Handler for LockServer.Execute
+// Sends the operation through ExecuteRequest, encoded the way the lock
+// server decodes it
+func (thisReplica *Replica) grpcExecuteLock(ctx context.Context, data []byte) ([]byte, error) {
+	msgID, lockCommand, err := unmarshalLockRequest(data)
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	// The client ids below 0 are reserved for the commands the replicas
+	// propose themselves, and for keep alives
+	if lockCommand.ClientID < 0 {
+		return nil, grpcError{grpcInvalidArgument, "Client ids below 0 are reserved"}
+	}
+	var response ClientResponse
+	request := ClientRequest{Command: encodeLockCommand(msgID, lockCommand)}
+	if err = thisReplica.executeRequest(ctx, request, &response); err != nil {
+		return nil, err
+	}
+	return marshalLockResponse(response, decodeLockResult(response.Result, response.Err)), nil
+}
+
+// Serves a unary gRPC method: reads the request message, calls handle
+// with it and writes the response message and the status. The context
+// handle gets is done once the caller gives up on the call.
+func grpcHandler(handle func(ctx context.Context, request []byte) ([]byte, error)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost ||
+			!strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(writer, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/grpc")
+		writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		ctx := request.Context()
+		if timeout, present := parseGRPCTimeout(request.Header.Get("Grpc-Timeout")); present {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		var response []byte
+		message, err := readGRPCMessage(request.Body)
+		if err == nil {
+			response, err = handle(ctx, message)
+		}
+		switch err {
+		case context.Canceled:
+			err = grpcError{grpcCanceled, err.Error()}
+		case context.DeadlineExceeded:
+			err = grpcError{grpcDeadlineExceeded, err.Error()}
+		}
+		if err == nil {
+			err = writeGRPCMessage(writer, response)
+		}
+		code := grpcOK
+		status := ""
+		if err != nil {
+			code = grpcUnknown
+			if grpcErr, ok := err.(grpcError); ok {
+				code = grpcErr.code
+			}
+			status = err.Error()
+		}
+		writer.Header().Set("Grpc-Status", strconv.Itoa(code))
+		writer.Header().Set("Grpc-Message", encodeGRPCMessage(status))
+	}
+}
+
+// Percent-encodes the message of a status for the grpc-message header,
+// which only carries printable ASCII: every other byte, and %, is written
+// as %XX
+func encodeGRPCMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		if message[i] < ' ' || message[i] > '~' || message[i] == '%' {
+			fmt.Fprintf(&encoded, "%%%02X", message[i])
+		} else {
+			encoded.WriteByte(message[i])
+		}
+	}
+	return encoded.String()
+}
+
+// Reads a message framed the gRPC way, with a compression flag and its
+// length
+func readGRPCMessage(body io.Reader) (message []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(body, header); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "Missing request message"}
+	}
+	if header[0] != 0 {
+		return nil, grpcError{grpcUnimplemented, "Compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > grpcMaxMessageSize {
+		return nil, grpcError{grpcInvalidArgument, "Request message too large"}
+	}
+	message = make([]byte, length)
+	if _, err = io.ReadFull(body, message); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "Truncated request message"}
+	}
+	return message, nil
+}
+
+func writeGRPCMessage(writer io.Writer, message []byte) (err error) {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	if _, err = writer.Write(frame); err != nil {
+		return grpcError{grpcInternal, err.Error()}
+	}
+	return nil
+}
+
+// Parses the grpc-timeout header of a request, e.g. 100m for 100ms
+func parseGRPCTimeout(header string) (timeout time.Duration, present bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, known := units[header[len(header)-1]]
+	value, err := strconv.ParseInt(header[:len(header)-1], 10, 64)
+	if !known || err != nil || value < 0 {
+		return 0, false
+	}
+	return time.Duration(value) * unit, true
+}
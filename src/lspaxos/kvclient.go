@@ -0,0 +1,55 @@
+package lspaxos
+
+import (
+	"log"
+)
+
+// Client of a key-value store replicated by the replicas. Every operation,
+// reads included, is decided in a slot, so the store is linearizable.
+type KVClient struct {
+	// Sends the operations to the replicas
+	client *Client
+}
+
+func StartKVClient(ClientID int, Replicas []string, Transport Transport) KVClient {
+	return KVClient{client: StartClient(ClientID, Replicas, 0, 0, 1, Transport)}
+}
+
+// Sends an operation to the replicas and decodes its result
+func (thisKVClient *KVClient) execute(command KVCommand) KVResult {
+	op, err := encodeRecord(command)
+	if err != nil {
+		log.Fatalf("Failed to encode key-value command %+v, %s\n", command, err)
+	}
+	data, clientErr := thisKVClient.client.Execute(op)
+	if clientErr != OK {
+		return KVResult{Err: clientErr}
+	}
+	var result KVResult
+	if err = decodeRecord(data, &result); err != nil {
+		return KVResult{Err: ErrInvalidCommand}
+	}
+	return result
+}
+
+// Returns the value of a key, or ErrNoKey
+func (thisKVClient *KVClient) Get(Key string) (string, Err) {
+	result := thisKVClient.execute(KVCommand{KVOp: Get, Key: Key})
+	return result.Value, result.Err
+}
+
+func (thisKVClient *KVClient) Put(Key string, Value string) Err {
+	return thisKVClient.execute(KVCommand{KVOp: Put, Key: Key, Value: Value}).Err
+}
+
+// Deletes a key, or returns ErrNoKey
+func (thisKVClient *KVClient) Delete(Key string) Err {
+	return thisKVClient.execute(KVCommand{KVOp: Delete, Key: Key}).Err
+}
+
+// Sets a key to Value if its value is Expected. Otherwise returns
+// ErrCompareFailed along with the current value, or ErrNoKey.
+func (thisKVClient *KVClient) CompareAndSwap(Key string, Expected string, Value string) (string, Err) {
+	result := thisKVClient.execute(KVCommand{KVOp: CompareAndSwap, Key: Key, Expected: Expected, Value: Value})
+	return result.Value, result.Err
+}
@@ -0,0 +1,110 @@
+package lspaxos
+
+import (
+	"log"
+)
+
+type KVOp string
+
+const (
+	Get            KVOp = "Get"
+	Put            KVOp = "Put"
+	Delete         KVOp = "Delete"
+	CompareAndSwap KVOp = "CompareAndSwap"
+)
+
+// Operation of the key-value store
+type KVCommand struct {
+	// Key operation
+	KVOp KVOp
+
+	Key string
+
+	// New value, for Put and CompareAndSwap
+	Value string
+
+	// Value the key must have for CompareAndSwap to succeed
+	Expected string
+}
+
+// Result of an operation of the key-value store
+type KVResult struct {
+	Err Err
+
+	// Value of the key, for Get
+	Value string
+}
+
+// State machine that stores string values by key
+type KVStore struct {
+	// Map from key to its value
+	values map[string]string
+}
+
+func NewKVStore() *KVStore {
+	return &KVStore{values: make(map[string]string)}
+}
+
+// Applies a KVCommand, the result is a KVResult
+func (thisKVStore *KVStore) Apply(command []byte) []byte {
+	var kvCommand KVCommand
+	result := KVResult{Err: OK}
+	if err := decodeRecord(command, &kvCommand); err != nil {
+		result.Err = ErrInvalidCommand
+		return encodeKVResult(result)
+	}
+	value, present := thisKVStore.values[kvCommand.Key]
+	switch kvCommand.KVOp {
+	case Get:
+		if present {
+			result.Value = value
+		} else {
+			result.Err = ErrNoKey
+		}
+	case Put:
+		thisKVStore.values[kvCommand.Key] = kvCommand.Value
+	case Delete:
+		if present {
+			delete(thisKVStore.values, kvCommand.Key)
+		} else {
+			result.Err = ErrNoKey
+		}
+	case CompareAndSwap:
+		if !present {
+			result.Err = ErrNoKey
+		} else if value != kvCommand.Expected {
+			result.Err = ErrCompareFailed
+			result.Value = value
+		} else {
+			thisKVStore.values[kvCommand.Key] = kvCommand.Value
+		}
+	default:
+		result.Err = ErrInvalidCommand
+	}
+	return encodeKVResult(result)
+}
+
+func encodeKVResult(result KVResult) []byte {
+	data, err := encodeRecord(result)
+	if err != nil {
+		log.Fatalf("Failed to encode key-value result %+v, %s\n", result, err)
+	}
+	return data
+}
+
+func (thisKVStore *KVStore) Snapshot() []byte {
+	snapshot, err := encodeRecord(thisKVStore.values)
+	if err != nil {
+		log.Fatalf("Failed to encode values %+v, %s\n", thisKVStore.values, err)
+	}
+	return snapshot
+}
+
+func (thisKVStore *KVStore) Restore(snapshot []byte) error {
+	values := make(map[string]string)
+	if err := decodeRecord(snapshot, &values); err != nil {
+		return err
+	}
+	thisKVStore.values = values
+	return nil
+}
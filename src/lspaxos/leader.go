@@ -1,9 +1,11 @@
 package lspaxos
 
 import (
+	"context"
 	"log"
-	"net"
-	"net/rpc"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +15,23 @@ const (
 	leaderInitialTimeout   = 100
 	leaderAdditiveIncrease = 50
 	leaderMultDecrease     = 2
+
+	// Name of the leader's log inside its data directory
+	leaderLogName = "leader.log"
+
+	// How long acceptors refuse the ballots of other leaders after the
+	// active leader adopted or renewed its ballot
+	leaderLeaseMillis = 500
+
+	// Number of times the active leader renews its lease per lease
+	leaseRenewalsPerLease = 3
+
+	// How often passive leaders send heartbeats to the lease holder
+	heartbeatMillis = leaderLeaseMillis / leaseRenewalsPerLease
+
+	// Number of heartbeats in a row the lease holder may miss before a
+	// passive leader tries to take over
+	missedHeartbeats = 3
 )
 
 type Leader struct {
@@ -22,21 +41,29 @@ type Leader struct {
 	// Identifies the leader as well as their round
 	ballot Ballot
 
-	// Addresses of the acceptors
-	acceptors []string
+	// Addresses of the acceptors of each configuration, keyed by the
+	// first slot the configuration decides
+	configs map[int][]string
 
 	// Flag to identify if this leader is the commander
 	active bool
 
-	// Number of responses to declare majority
-	majority int
+	// Address of the leader holding the lease of the acceptors, set
+	// while this one is passive because acceptors refused its ballot
+	leaseHolder string
+
+	// Context of the requests forwarded to leaseHolder, canceled by
+	// stopForwarding once this leader stops forwarding to it
+	forwarding     context.Context
+	stopForwarding context.CancelFunc
+
+	// When a majority of the acceptors last renewed the lease of this
+	// leader, while it is active
+	leaseRenewed time.Time
 
 	// Current timeout for Scout process
 	timeout int
 
-	// Channel that communicates with acceptors in the Scout process
-	scoutChannel chan interface{}
-
 	// Lock to control access to the proposals map
 	mu sync.Mutex
 
@@ -46,14 +73,27 @@ type Leader struct {
 	// Decisions map (slot number to command)
 	decisions map[int]Command
 
+	// Every replica has applied the slots below this one, so the
+	// leader no longer keeps proposals or decisions for them
+	compactedSlot int
+
 	// Condition variable for when you need to scout
 	needToScout sync.Cond
 
 	// Condition variable for when something is decided
 	somethingDecided sync.Cond
 
-	// Listener
-	listener net.Listener
+	// Highest ballot number that is durable in the log. A ballot is only
+	// sent to acceptors once it is, so that a restarted leader never
+	// reuses a ballot number
+	persistedNumber int
+
+	// Durable log of ballot numbers and decisions, nil if the leader
+	// was started without a data directory
+	wal *writeAheadLog
+
+	// Carries the RPCs of the leader
+	transport Transport
 
 	// Address
 	Address string
@@ -62,6 +102,98 @@ type Leader struct {
 	dead int32
 }
 
+// Record written to the leader's log, either the ballot number it is
+// about to use, a decision learned by one of its commanders, the slot
+// below which everything was garbage collected, or the acceptors of a
+// configuration that is in force from Slot on
+type leaderRecord struct {
+	Number int
+
+	Decided bool
+
+	Compacted bool
+
+	Configured bool
+
+	Slot int
+
+	Command Command
+
+	Acceptors []string
+}
+
+// Number of responses to declare majority among numAcceptors acceptors
+func majority(numAcceptors int) int {
+	return numAcceptors/2 + 1
+}
+
+// Returns the acceptors of the configuration the slot is decided under
+// Must be called with the lock held
+func (thisLeader *Leader) acceptorsAt(slot int) []string {
+	configSlot := 0
+	for start := range thisLeader.configs {
+		if start <= slot && start > configSlot {
+			configSlot = start
+		}
+	}
+	return thisLeader.configs[configSlot]
+}
+
+// Forgets the configurations that only decide compacted slots
+// Must be called with the lock held
+func (thisLeader *Leader) retireConfigs() {
+	for start := range thisLeader.configs {
+		for next := range thisLeader.configs {
+			if start < next && next <= thisLeader.compactedSlot {
+				delete(thisLeader.configs, start)
+				break
+			}
+		}
+	}
+}
+
+// Returns the acceptors of every configuration that is not retired
+// Must be called with the lock held
+func (thisLeader *Leader) liveAcceptors() (acceptors []string) {
+	seen := make(map[string]bool)
+	for _, configAcceptors := range thisLeader.configs {
+		for _, acceptor := range configAcceptors {
+			if !seen[acceptor] {
+				seen[acceptor] = true
+				acceptors = append(acceptors, acceptor)
+			}
+		}
+	}
+	return acceptors
+}
+
+// Tells if a majority of the acceptors of every configuration that is
+// not retired adopted the ballot
+// Must be called with the lock held
+func (thisLeader *Leader) adopted(received map[string]bool) bool {
+	for _, acceptors := range thisLeader.configs {
+		count := 0
+		for _, acceptor := range acceptors {
+			if received[acceptor] {
+				count++
+			}
+		}
+		if count < majority(len(acceptors)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Persists a record if the leader has a log
+// Must be called with the lock held
+func (thisLeader *Leader) persist(record leaderRecord) (err error) {
+	if thisLeader.wal == nil {
+		return nil
+	}
+	return thisLeader.wal.append(record)
+}
+
 func (thisLeader *Leader) scout() {
 	for {
 		thisLeader.mu.Lock()
@@ -70,27 +202,57 @@ func (thisLeader *Leader) scout() {
 		}
 
 		for !thisLeader.active {
+			// Make the ballot durable before any acceptor sees it
+			if thisLeader.ballot.Number > thisLeader.persistedNumber {
+				err := thisLeader.persist(leaderRecord{Number: thisLeader.ballot.Number})
+				if err != nil {
+					log.Printf("Leader %d failed to persist ballot %+v, %s\n", thisLeader.leaderID, thisLeader.ballot, err)
+					thisLeader.mu.Unlock()
+					time.Sleep(time.Duration(thisLeader.timeout) * time.Millisecond)
+					thisLeader.mu.Lock()
+					continue
+				}
+				thisLeader.persistedNumber = thisLeader.ballot.Number
+			}
+
 			// Set of acceptors we've received from
-			var received = make(map[int]bool)
-			// Probe the acceptors
-			var request = ScoutRequest{Ballot: thisLeader.ballot}
-			for _, acceptor := range thisLeader.acceptors {
+			var received = make(map[string]bool)
+			// Channel that communicates with acceptors in this round, so
+			// that responses from earlier rounds are not mistaken for
+			// refusals of this one
+			acceptors := thisLeader.liveAcceptors()
+			scoutChannel := make(chan interface{}, len(acceptors))
+			// Acceptors that don't answer in time count as failed, so that
+			// a slow one cannot hold up the scout
+			ctx, cancel := rpcContext()
+			// Probe the acceptors of every configuration, since slots
+			// may still be decided under any of them
+			for _, acceptor := range acceptors {
+				request := ScoutRequest{
+					Ballot:  thisLeader.ballot,
+					Slot:    thisLeader.compactedSlot,
+					Leader:  thisLeader.Address,
+					Address: acceptor,
+				}
 				response := new(ScoutResponse)
-				go Call(
+				go CallWithRetries(
+					ctx,
+					thisLeader.transport,
 					acceptor,
 					"Acceptor.ExecutePropose",
 					request,
 					response,
-					thisLeader.scoutChannel,
+					scoutChannel,
 				)
 			}
 
 			// Listen for responses
-			for len(received) < thisLeader.majority {
-				response := <-thisLeader.scoutChannel
+			leaseHolder := ""
+			for responses := 0; !thisLeader.adopted(received) && responses < len(acceptors); responses++ {
+				response := <-scoutChannel
 				if response == false {
-					// Guaranteed to get a majority of responses according to spec
-					// (i.e. Don't need to resend messages)
+					// Not adopted if too many acceptors fail, the scout
+					// tries again after sleeping
 					log.Printf(
 						"Failed to get response from an acceptor on scout %d\n",
 						thisLeader.leaderID,
@@ -100,17 +262,26 @@ func (thisLeader *Leader) scout() {
 
 				var res = response.(*ScoutResponse)
 				var compareResult = thisLeader.ballot.Compare(res.Ballot)
-				if compareResult < 0 {
+				if res.LeaseHolder != "" {
+					// Another leader holds the lease of this acceptor, no
+					// need to compete unless the others make a majority.
+					// Leaders whose leases are split across the acceptors
+					// would otherwise all stay passive.
+					leaseHolder = res.LeaseHolder
+					continue
+				} else if compareResult < 0 {
 					// We're pre-empted by somebody else, exit the loop
 					thisLeader.ballot.Number = res.Ballot.Number + 1
 					break
 				} else if compareResult == 0 {
 					// Only record if the acceptor updated with our ballot number
-					received[res.AcceptorID] = true
+					received[res.Address] = true
 					// Merge the proposal map with what was received from
-					// the acceptor
+					// the acceptor, skipping what we know to be decided
 					for slot, acceptedCommand := range res.AcceptedValues {
-						thisLeader.proposals[slot] = acceptedCommand
+						if _, decided := thisLeader.decisions[slot]; !decided && slot >= thisLeader.compactedSlot {
+							thisLeader.proposals[slot] = acceptedCommand
+						}
 					}
 				}
 
@@ -120,13 +291,35 @@ func (thisLeader *Leader) scout() {
 				// its ballot number immediately upon seeing a higher ballot
 				// So just ignore
 			}
+			cancel()
+
+			if leaseHolder != "" && !thisLeader.adopted(received) {
+				// Stay passive and forward to the lease holder for as
+				// long as it answers heartbeats. The jitter keeps leaders
+				// that noticed its failure together from scouting at the
+				// same time.
+				log.Printf("Leader %d is passive, %s holds the lease\n", thisLeader.leaderID, leaseHolder)
+				thisLeader.setLeaseHolder(leaseHolder)
+				thisLeader.mu.Unlock()
+				thisLeader.watchLeader(leaseHolder)
+				thisLeader.mu.Lock()
+				thisLeader.setLeaseHolder("")
+				thisLeader.mu.Unlock()
+				time.Sleep(time.Duration(rand.Intn(leaderLeaseMillis)) * time.Millisecond)
+				thisLeader.mu.Lock()
+				continue
+			}
 
 			// Case where we got pre-empted
-			if len(received) < thisLeader.majority {
+			if !thisLeader.adopted(received) {
 				// Sleep, then increment our timeout and ballot round
 				// Make explicit that we are no longer the leader
+				// The lock is released meanwhile, so that the leader keeps
+				// answering while it cannot get a majority
 				log.Printf("Leader %d is sleeping for %d milliseconds\n", thisLeader.leaderID, thisLeader.timeout)
+				thisLeader.mu.Unlock()
 				time.Sleep(time.Duration(thisLeader.timeout) * time.Millisecond)
+				thisLeader.mu.Lock()
 				log.Printf("Leader %d is done sleeping\n", thisLeader.leaderID)
 				thisLeader.timeout += leaderAdditiveIncrease
 				thisLeader.active = false
@@ -134,29 +327,39 @@ func (thisLeader *Leader) scout() {
 				// Hooray, we are the leader
 				// Decrement our timeout and then break out of the Scout loop
 				thisLeader.active = true
+				thisLeader.setLeaseHolder("")
+				thisLeader.leaseRenewed = time.Now()
 				thisLeader.timeout /= leaderMultDecrease
 				log.Printf("Leader %+v is Spartacus\n", thisLeader.ballot)
 			}
 		}
 		for slot, command := range thisLeader.proposals {
-			go thisLeader.commander(slot, command, thisLeader.ballot)
+			go thisLeader.commander(slot, command, thisLeader.ballot, thisLeader.acceptorsAt(slot))
 		}
 		thisLeader.mu.Unlock()
 	}
 }
 
-func (thisLeader *Leader) commander(slot int, command Command, ballot Ballot) {
+// Gets the command accepted for the slot by a majority of the given
+// acceptors, which are those of the configuration the slot is decided under
+func (thisLeader *Leader) commander(slot int, command Command, ballot Ballot, acceptors []string) {
 	// Set of acceptors we've received from
-	var received = make(map[int]bool)
+	var received = make(map[string]bool)
 
 	// Channel that communicates with acceptors in the Scout process
-	commanderChannel := make(chan interface{}, len(thisLeader.acceptors))
+	commanderChannel := make(chan interface{}, len(acceptors))
+
+	// Acceptors that don't answer in time count as failed
+	ctx, cancel := rpcContext()
+	defer cancel()
 
 	// Probe the acceptors
-	var request = CommanderRequest{Command: command, Slot: slot, Ballot: ballot}
-	for _, acceptor := range thisLeader.acceptors {
+	for _, acceptor := range acceptors {
+		request := CommanderRequest{Command: command, Slot: slot, Ballot: ballot, Address: acceptor}
 		response := new(CommanderResponse)
-		go Call(
+		go CallWithRetries(
+			ctx,
+			thisLeader.transport,
 			acceptor,
 			"Acceptor.ExecuteAccept",
 			request,
@@ -165,16 +368,35 @@ func (thisLeader *Leader) commander(slot int, command Command, ballot Ballot) {
 		)
 	}
 
-	for len(received) < thisLeader.majority {
+	for responses := 0; len(received) < majority(len(acceptors)); responses++ {
+		if responses == len(acceptors) {
+			// Too many acceptors failed. Scouting again spawns a new
+			// commander for every slot that is still undecided.
+			thisLeader.mu.Lock()
+			if thisLeader.ballot.Compare(ballot) == 0 && thisLeader.active {
+				log.Printf("Leader %d could not reach a majority for slot %d\n", thisLeader.leaderID, slot)
+				thisLeader.active = false
+				thisLeader.needToScout.Signal()
+			}
+			thisLeader.mu.Unlock()
+			return
+		}
 		response := <-commanderChannel
 		if response == false {
 			log.Printf("Response from acceptor failed on scout %d\n", thisLeader.leaderID)
 			continue
 		}
 		commanderResponse := response.(*CommanderResponse)
-		log.Printf("Leader %d received a commander response from acceptor %+v, request %+v\n", thisLeader.leaderID, commanderResponse, request.Command)
-		if ballot.Compare(commanderResponse.Ballot) == 0 {
-			received[commanderResponse.AcceptorID] = true
+		log.Printf("Leader %d received a commander response from acceptor %+v, command %+v\n", thisLeader.leaderID, commanderResponse, command)
+		if commanderResponse.Err == ErrCompacted {
+			// Decided long ago, the replicas will tell this leader to
+			// compact it as well
+			thisLeader.mu.Lock()
+			delete(thisLeader.proposals, slot)
+			thisLeader.mu.Unlock()
+			return
+		} else if ballot.Compare(commanderResponse.Ballot) == 0 {
+			received[commanderResponse.Address] = true
 		} else if ballot.Compare(commanderResponse.Ballot) < 0 {
 			// Preempted
 			thisLeader.mu.Lock()
@@ -193,20 +415,173 @@ func (thisLeader *Leader) commander(slot int, command Command, ballot Ballot) {
 	}
 
 	thisLeader.mu.Lock()
+	thisLeader.learnDecision(slot, command)
+	thisLeader.mu.Unlock()
+}
+
+// Records the command decided for a slot, unless it is known already
+// Must be called with the lock held
+func (thisLeader *Leader) learnDecision(slot int, command Command) {
+	if _, decided := thisLeader.decisions[slot]; decided || slot < thisLeader.compactedSlot {
+		return
+	}
+	err := thisLeader.persist(leaderRecord{Decided: true, Slot: slot, Command: command})
+	if err != nil {
+		log.Printf("Leader %d failed to persist decision for slot %d, %s\n", thisLeader.leaderID, slot, err)
+		return
+	}
 	thisLeader.decisions[slot] = command
 	delete(thisLeader.proposals, slot)
 	thisLeader.somethingDecided.Broadcast()
+}
+
+// Renews the lease of the leader at the acceptors while it is active, so
+// that the other leaders stay passive. A leader that learns it was
+// preempted in the meantime scouts again, and so does a leader that could
+// not renew its lease for a whole lease, so that its heartbeats tell the
+// passive leaders to take over.
+func (thisLeader *Leader) renewLease() {
+	for !thisLeader.isDead() {
+		time.Sleep(leaderLeaseMillis / leaseRenewalsPerLease * time.Millisecond)
+		thisLeader.mu.Lock()
+		if !thisLeader.active {
+			thisLeader.mu.Unlock()
+			continue
+		}
+		if time.Since(thisLeader.leaseRenewed) > leaderLeaseMillis*time.Millisecond {
+			log.Printf("Leader %d could not renew its lease\n", thisLeader.leaderID)
+			thisLeader.active = false
+			thisLeader.needToScout.Signal()
+			thisLeader.mu.Unlock()
+			continue
+		}
+		ballot := thisLeader.ballot
+		acceptors := thisLeader.liveAcceptors()
+		thisLeader.mu.Unlock()
+
+		leaseChannel := make(chan interface{}, len(acceptors))
+		// Renewals that arrive after the next one are of no use
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatMillis*time.Millisecond)
+		for _, acceptor := range acceptors {
+			request := LeaseRequest{Ballot: ballot, Leader: thisLeader.Address, Address: acceptor}
+			response := new(LeaseResponse)
+			go CallContext(ctx, thisLeader.transport, acceptor, "Acceptor.ExecuteRenewLease", request, response, leaseChannel)
+		}
+		go func() {
+			defer cancel()
+			// Set of acceptors that renewed the lease
+			received := make(map[string]bool)
+			for range acceptors {
+				response := <-leaseChannel
+				if response == false {
+					continue
+				}
+				res := response.(*LeaseResponse)
+				thisLeader.mu.Lock()
+				if ballot.Compare(res.Ballot) == 0 {
+					received[res.Address] = true
+					if thisLeader.ballot.Compare(ballot) == 0 && thisLeader.adopted(received) {
+						thisLeader.leaseRenewed = time.Now()
+					}
+				} else if ballot.Compare(res.Ballot) < 0 && thisLeader.ballot.Compare(ballot) == 0 {
+					log.Printf("Leader %d was preempted while renewing its lease\n", thisLeader.leaderID)
+					thisLeader.active = false
+					thisLeader.ballot.Number = res.Ballot.Number + 1
+					thisLeader.needToScout.Signal()
+				}
+				thisLeader.mu.Unlock()
+			}
+		}()
+	}
+}
+
+// Sends heartbeats to the leader holding the lease until it misses
+// missedHeartbeats of them in a row, or answers that it is no longer the
+// commander, so that this leader can take over
+func (thisLeader *Leader) watchLeader(leaseHolder string) {
+	for missed := 0; missed < missedHeartbeats && !thisLeader.isDead(); {
+		time.Sleep(heartbeatMillis * time.Millisecond)
+		heartbeatChannel := make(chan interface{}, 1)
+		request := HeartbeatRequest{Address: leaseHolder}
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatMillis*time.Millisecond)
+		CallContext(ctx, thisLeader.transport, leaseHolder, "Leader.ExecuteHeartbeat", request, new(HeartbeatResponse), heartbeatChannel)
+		cancel()
+		response := <-heartbeatChannel
+		if response == false {
+			missed++
+		} else if !response.(*HeartbeatResponse).Active {
+			log.Printf("Leader %d learned %s is no longer active\n", thisLeader.leaderID, leaseHolder)
+			return
+		} else {
+			missed = 0
+		}
+	}
+	log.Printf("Leader %d lost the heartbeats of %s\n", thisLeader.leaderID, leaseHolder)
+}
+
+// Sets the leader this one forwards replica requests to, "" for none.
+// The requests still forwarded to the previous one are canceled, and
+// handled by this leader instead.
+// Must be called with the lock held
+func (thisLeader *Leader) setLeaseHolder(leaseHolder string) {
+	if thisLeader.stopForwarding != nil {
+		thisLeader.stopForwarding()
+	}
+	thisLeader.leaseHolder = leaseHolder
+	thisLeader.forwarding, thisLeader.stopForwarding = context.WithCancel(context.Background())
+}
+
+// Handler for heartbeats from passive leaders
+func (thisLeader *Leader) ExecuteHeartbeat(req HeartbeatRequest, res *HeartbeatResponse) (err error) {
+	thisLeader.mu.Lock()
+	defer thisLeader.mu.Unlock()
+	res.Active = thisLeader.active
+	res.Ballot = thisLeader.ballot
+	return nil
+}
+
+// Forwards a replica request to the leader holding the lease, and records
+// the decision it responds with. Returns false if that leader could not
+// be reached, or this leader stopped forwarding to it (e.g. it missed its
+// heartbeats) before it answered, in which case the request is left to
+// this leader.
+// Must be called with the lock held
+func (thisLeader *Leader) forward(req ReplicaRequest, res *ReplicaResponse) bool {
+	leaseHolder := thisLeader.leaseHolder
+	ctx := thisLeader.forwarding
+	req.Forwarded = true
+	response := new(ReplicaResponse)
+	forwardChannel := make(chan interface{}, 1)
 	thisLeader.mu.Unlock()
+	CallContext(ctx, thisLeader.transport, leaseHolder, "Leader.ExecutePropose", req, response, forwardChannel)
+	thisLeader.mu.Lock()
+	if <-forwardChannel == false {
+		log.Printf("Leader %d failed to forward slot %d to %s\n", thisLeader.leaderID, req.Slot, leaseHolder)
+		return false
+	}
+	*res = *response
+	if response.Err == OK {
+		thisLeader.learnDecision(response.Slot, response.Command)
+	}
+	return true
 }
 
 func (thisLeader *Leader) ExecutePropose(req ReplicaRequest, res *ReplicaResponse) (err error) {
 	res.Slot = req.Slot
+	res.Err = OK
 	log.Printf("Leader %d got a replica request %+v\n", thisLeader.leaderID, req)
 	thisLeader.mu.Lock()
 	defer thisLeader.mu.Unlock()
 	decision, decided := thisLeader.decisions[req.Slot]
-	if decided {
+	if req.Slot >= thisLeader.compactedSlot && req.Acceptors != nil {
+		thisLeader.learnConfig(req.ConfigSlot, req.Acceptors)
+	}
+	if req.Slot < thisLeader.compactedSlot {
+		res.Err = ErrCompacted
+	} else if decided {
 		res.Command = decision
+	} else if !thisLeader.active && thisLeader.leaseHolder != "" && !req.Forwarded && thisLeader.forward(req, res) {
+		log.Printf("Leader %d forwarded slot %d, decided %+v\n", thisLeader.leaderID, res.Slot, res.Command)
 	} else {
 		alreadyProposed := false
 		for _, proposal := range thisLeader.proposals {
@@ -219,13 +594,16 @@ func (thisLeader *Leader) ExecutePropose(req ReplicaRequest, res *ReplicaRespons
 		if !alreadyProposed && !reqSlotIsUsed {
 			thisLeader.proposals[req.Slot] = req.Command
 			if thisLeader.active {
-				go thisLeader.commander(req.Slot, req.Command, thisLeader.ballot)
+				go thisLeader.commander(req.Slot, req.Command, thisLeader.ballot, thisLeader.acceptorsAt(req.Slot))
 			}
 		}
 
 		for ; !decided; _, decided = thisLeader.decisions[req.Slot] {
 			thisLeader.somethingDecided.Wait()
-
+			if req.Slot < thisLeader.compactedSlot {
+				res.Err = ErrCompacted
+				return nil
+			}
 		}
 		res.Command = thisLeader.decisions[req.Slot]
 		log.Printf("Leader %d decided %+v for slot %d\n", thisLeader.leaderID, res.Command, res.Slot)
@@ -233,11 +611,109 @@ func (thisLeader *Leader) ExecutePropose(req ReplicaRequest, res *ReplicaRespons
 	return nil
 }
 
+// Records the acceptors of a configuration the leader did not know of.
+// The acceptors of the new configuration have not adopted the ballot of
+// the leader yet, so it stops proposing and scouts again.
+// Must be called with the lock held
+func (thisLeader *Leader) learnConfig(configSlot int, acceptors []string) {
+	if _, known := thisLeader.configs[configSlot]; known {
+		return
+	}
+	err := thisLeader.persist(leaderRecord{Configured: true, Slot: configSlot, Acceptors: acceptors})
+	if err != nil {
+		log.Printf("Leader %d failed to persist configuration for slot %d, %s\n", thisLeader.leaderID, configSlot, err)
+		return
+	}
+	log.Printf("Leader %d learned acceptors %v in force from slot %d\n", thisLeader.leaderID, acceptors, configSlot)
+	thisLeader.configs[configSlot] = acceptors
+	thisLeader.retireConfigs()
+	thisLeader.active = false
+	thisLeader.needToScout.Signal()
+}
+
+// Handler for replicas catching up after a restart
+// Responds with all the decisions this leader knows of from the requested slot on
+func (thisLeader *Leader) ExecuteCatchUp(req CatchUpRequest, res *CatchUpResponse) (err error) {
+	log.Printf("Leader %d got a catch up request %+v\n", thisLeader.leaderID, req)
+	thisLeader.mu.Lock()
+	defer thisLeader.mu.Unlock()
+	res.Decisions = make(map[int]Command)
+	for slot, command := range thisLeader.decisions {
+		if slot >= req.Slot {
+			res.Decisions[slot] = command
+		}
+	}
+	return nil
+}
+
+// Handler for compaction requests from replicas
+// Forgets the proposals and decisions for every slot below the requested
+// one, and forwards the request to the acceptors
+func (thisLeader *Leader) ExecuteCompact(req CompactRequest, res *CompactResponse) (err error) {
+	thisLeader.mu.Lock()
+	defer thisLeader.mu.Unlock()
+	if req.Slot <= thisLeader.compactedSlot {
+		return nil
+	}
+	log.Printf("Leader %d compacting slots below %d\n", thisLeader.leaderID, req.Slot)
+	for slot := range thisLeader.decisions {
+		if slot < req.Slot {
+			delete(thisLeader.decisions, slot)
+		}
+	}
+	for slot := range thisLeader.proposals {
+		if slot < req.Slot {
+			delete(thisLeader.proposals, slot)
+		}
+	}
+	thisLeader.compactedSlot = req.Slot
+	thisLeader.retireConfigs()
+	// Wake up replica requests waiting on a slot that was just compacted
+	thisLeader.somethingDecided.Broadcast()
+
+	acceptors := thisLeader.liveAcceptors()
+	compactChannel := make(chan interface{}, len(acceptors))
+	ctx, cancel := rpcContext()
+	for _, acceptor := range acceptors {
+		response := new(CompactResponse)
+		go CallContext(ctx, thisLeader.transport, acceptor, "Acceptor.ExecuteCompact", req, response, compactChannel)
+	}
+	// Nobody waits for the acceptors, they compact on their own time
+	go func() {
+		for range acceptors {
+			<-compactChannel
+		}
+		cancel()
+	}()
+	if thisLeader.wal == nil {
+		return nil
+	}
+
+	// Rewrite the log with just enough records to rebuild the current state
+	records := []interface{}{
+		leaderRecord{Number: thisLeader.persistedNumber},
+		leaderRecord{Compacted: true, Slot: thisLeader.compactedSlot},
+	}
+	for slot, command := range thisLeader.decisions {
+		records = append(records, leaderRecord{Decided: true, Slot: slot, Command: command})
+	}
+	for slot, acceptors := range thisLeader.configs {
+		records = append(records, leaderRecord{Configured: true, Slot: slot, Acceptors: acceptors})
+	}
+	if err = thisLeader.wal.rewrite(records); err != nil {
+		log.Printf("Leader %d failed to compact its log, %s\n", thisLeader.leaderID, err)
+	}
+	return err
+}
+
 func (thisLeader *Leader) kill() {
 	log.Printf("Killing leader %d\n", thisLeader.leaderID)
 	atomic.StoreInt32(&thisLeader.dead, 1)
-	if thisLeader.listener != nil {
-		thisLeader.listener.Close()
+	if thisLeader.Address != "" {
+		thisLeader.transport.Close(thisLeader.Address)
+	}
+	if thisLeader.wal != nil {
+		thisLeader.wal.close()
 	}
 }
 
@@ -245,11 +721,87 @@ func (thisLeader *Leader) isDead() bool {
 	return atomic.LoadInt32(&thisLeader.dead) != 0
 }
 
+// Opens the leader's log in DataDir and replays it to restore the
+// decisions and the highest ballot number used before a restart
+func (thisLeader *Leader) recover(DataDir string) (err error) {
+	if err = os.MkdirAll(DataDir, 0755); err != nil {
+		return err
+	}
+	thisLeader.wal, err = openWriteAheadLog(filepath.Join(DataDir, leaderLogName))
+	if err != nil {
+		return err
+	}
+	err = thisLeader.wal.replay(func(data []byte) error {
+		var record leaderRecord
+		if err := decodeRecord(data, &record); err != nil {
+			return err
+		}
+		if record.Decided {
+			thisLeader.decisions[record.Slot] = record.Command
+		} else if record.Compacted {
+			thisLeader.compactedSlot = record.Slot
+		} else if record.Configured {
+			thisLeader.configs[record.Slot] = record.Acceptors
+		} else if record.Number > thisLeader.persistedNumber {
+			thisLeader.persistedNumber = record.Number
+		}
+		return nil
+	})
+	thisLeader.retireConfigs()
+	// Never reuse a ballot number that may have been sent before the restart
+	thisLeader.ballot.Number = thisLeader.persistedNumber + 1
+	return err
+}
+
 //StartLeader starts an acceptor instance and returns an Leader struct.
 //The struct can be used to kill this instance.
-func StartLeader(LeaderID int, AcceptorAddresses []string, Address string) (leader *Leader) {
-	server := rpc.NewServer()
-	listener, err := net.Listen("tcp", Address)
+//Ballot numbers and decisions are logged to DataDir, and a leader
+//restarted on the same DataDir serves the decided slots from its log and
+//rebuilds its proposals by scouting with a ballot it has not used before.
+//An empty DataDir keeps the state in memory only.
+//AcceptorAddresses are the acceptors of the initial configuration; the
+//leader learns about later ones from the proposals of the replicas.
+func StartLeader(
+	LeaderID int,
+	AcceptorAddresses []string,
+	Address string,
+	DataDir string,
+	Transport Transport,
+) (leader *Leader) {
+	leader = &Leader{
+		mu:              sync.Mutex{},
+		leaderID:        LeaderID,
+		ballot:          Ballot{Number: 0, Leader: LeaderID},
+		persistedNumber: -1,
+		configs:         map[int][]string{1: AcceptorAddresses},
+		active:          false,
+		timeout:         leaderInitialTimeout,
+		proposals:       make(map[int]Command),
+		decisions:       make(map[int]Command),
+		dead:            0,
+	}
+	leader.needToScout = sync.Cond{L: &leader.mu}
+	leader.somethingDecided = sync.Cond{L: &leader.mu}
+	if DataDir != "" {
+		if err := leader.recover(DataDir); err != nil {
+			log.Fatalf(
+				"Leader %d failed to recover from %s, %s\n",
+				LeaderID,
+				DataDir,
+				err,
+			)
+			return nil
+		}
+		log.Printf(
+			"Leader %d recovered ballot %+v, decisions: %+v\n",
+			LeaderID,
+			leader.ballot,
+			leader.decisions,
+		)
+	}
+
+	leader.transport = Transport
+	address, err := Transport.Serve(Address, leader)
 	if err != nil {
 		log.Fatalf(
 			"Leader %d failed to set up listening address %s, %s\n",
@@ -259,36 +811,9 @@ func StartLeader(LeaderID int, AcceptorAddresses []string, Address string) (lead
 		)
 		return nil
 	}
-	leader = &Leader{
-		mu:           sync.Mutex{},
-		leaderID:     LeaderID,
-		ballot:       Ballot{Number: 0, Leader: LeaderID},
-		acceptors:    AcceptorAddresses,
-		active:       false,
-		majority:     (len(AcceptorAddresses)+1)/2 + (len(AcceptorAddresses)+1)%2,
-		timeout:      leaderInitialTimeout,
-		scoutChannel: make(chan interface{}, ChannelBufferSize),
-		proposals:    make(map[int]Command),
-		decisions:    make(map[int]Command),
-		listener:     listener,
-		dead:         0,
-		Address:      listener.Addr().String(),
-	}
-	leader.needToScout = sync.Cond{L: &leader.mu}
-	leader.somethingDecided = sync.Cond{L: &leader.mu}
-	server.Register(leader)
+	leader.Address = address
 
 	go leader.scout()
-
-	go func() {
-		for !leader.isDead() {
-			connection, err := leader.listener.Accept()
-			if err == nil {
-				go server.ServeConn(connection)
-			} else if err != nil && !leader.isDead() {
-				log.Fatalf("Leader %d failed to accept connection, %s\n", LeaderID, err)
-			}
-		}
-	}()
+	go leader.renewLease()
 	return leader
 }
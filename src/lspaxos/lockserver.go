@@ -0,0 +1,640 @@
+package lspaxos
+
+import (
+	"log"
+	"sort"
+)
+
+// Operation of the lock server
+type LockCommand struct {
+	// Lock name. Names are paths like /svc/db/shard-3, where / separates
+	// the levels of the hierarchy. For List, the prefix to list the
+	// locks under.
+	LockName string
+
+	// Lock operation
+	LockOp LockOp
+
+	// Client Id, the owner of the lock if it is granted
+	ClientID int
+
+	// For Lock, how long the lock is held unless it is locked again.
+	// 0 holds it until it is unlocked.
+	// For OpenSession and KeepAlive, how long the session lasts unless
+	// it is kept alive again.
+	TTLMillis int64
+
+	// For Lock and RLock, wait in line for the lock if someone else
+	// holds it instead of failing with ErrLockHeld
+	Wait bool
+
+	// For Lock, also lock every lock under this one: no other client can
+	// lock them while this client holds it
+	Tree bool
+}
+
+// Result of an operation of the lock server
+type LockResult struct {
+	Err Err
+
+	// For a granted Lock, the fencing token of the grant. Tokens increase
+	// with every grant of any lock, so a storage system that remembers the
+	// highest token it has seen for a lock can reject the writes of a
+	// client that lost the lock in the meantime.
+	Token int64
+
+	// For List, the holders of the locks under the prefix, by lock name
+	Holders []LockHolder
+}
+
+// A client holding a lock
+type LockHolder struct {
+	LockName string
+
+	ClientID int
+
+	// Set if the client holds the lock shared
+	Shared bool
+}
+
+// State machine that grants named locks to clients
+type LockServer struct {
+	// Map from lock name to client holding it exclusively
+	locks map[string]int
+
+	// Map from lock name to the clients holding it shared. A lock is
+	// either in locks or in readers, not both.
+	readers map[string]map[int]bool
+
+	// Set of the locks held exclusively that also lock the locks under
+	// them
+	trees map[string]bool
+
+	// Map from lock name to the fencing token it was granted with
+	tokens map[string]int64
+
+	// Fencing token of the latest grant
+	lastToken int64
+
+	// Map from lock name to the time its lease expires, for the locks
+	// that were granted with a TTL
+	expiries map[string]int64
+
+	// Map from client to the time its session expires, for the clients
+	// that have one
+	sessions map[int]int64
+
+	// Map from lock name to the clients waiting for it, in the order
+	// they asked for it
+	waiters map[string][]lockWaiter
+
+	// Results of the waits that ended since the last call to Completed,
+	// by client. Not part of the snapshot, the replica collects them
+	// right after every slot.
+	completed map[int][]byte
+
+	// Events since the last call to Events. Not part of the snapshot
+	// either.
+	events []Event
+
+	// Replicated clock, 0 until the first tick
+	now int64
+}
+
+// A client waiting for a lock
+type lockWaiter struct {
+	ClientID int
+
+	// TTL of the lease the client gets when the lock is granted to it
+	TTLMillis int64
+
+	// Set if the client waits to hold the lock shared
+	Shared bool
+
+	// Set if the client waits to lock the locks under it as well
+	Tree bool
+}
+
+// State of the lock server, as encoded in its snapshots
+type lockServerState struct {
+	Locks map[string]int
+
+	Readers map[string]map[int]bool
+
+	Trees map[string]bool
+
+	Tokens map[string]int64
+
+	LastToken int64
+
+	Expiries map[string]int64
+
+	Sessions map[int]int64
+
+	Waiters map[string][]lockWaiter
+
+	Now int64
+}
+
+func NewLockServer() *LockServer {
+	return &LockServer{
+		locks:     make(map[string]int),
+		readers:   make(map[string]map[int]bool),
+		trees:     make(map[string]bool),
+		tokens:    make(map[string]int64),
+		expiries:  make(map[string]int64),
+		sessions:  make(map[int]int64),
+		waiters:   make(map[string][]lockWaiter),
+		completed: make(map[int][]byte),
+	}
+}
+
+// Builds the command a client sends for a lock operation
+func newLockCommand(ClientID int, MsgID int, LockName string, LockOp LockOp) Command {
+	return encodeLockCommand(MsgID, LockCommand{LockName: LockName, LockOp: LockOp, ClientID: ClientID})
+}
+
+func encodeLockCommand(MsgID int, lockCommand LockCommand) Command {
+	op, err := encodeRecord(lockCommand)
+	if err != nil {
+		log.Fatalf("Failed to encode lock command %+v, %s\n", lockCommand, err)
+	}
+	return Command{Kind: Operation, Op: op, MsgID: MsgID, ClientID: lockCommand.ClientID}
+}
+
+func encodeLockResult(result LockResult) []byte {
+	data, err := encodeRecord(result)
+	if err != nil {
+		log.Fatalf("Failed to encode lock result %+v, %s\n", result, err)
+	}
+	return data
+}
+
+// Decodes what a replica returned for a lock server operation
+func decodeLockResult(result []byte, err Err) LockResult {
+	if err != OK {
+		return LockResult{Err: err}
+	}
+	var decoded LockResult
+	if decodeRecord(result, &decoded) != nil {
+		return LockResult{Err: ErrInvalidCommand}
+	}
+	return decoded
+}
+
+// Locks or unlocks a lock, the result is a LockResult. A Lock that waits
+// for a held lock returns nil, its result is in Completed once the lock
+// is granted to it.
+func (thisLockServer *LockServer) Apply(command []byte) []byte {
+	var lockCommand LockCommand
+	if err := decodeRecord(command, &lockCommand); err != nil {
+		return encodeLockResult(LockResult{Err: ErrInvalidCommand})
+	}
+	result := LockResult{Err: OK}
+	lockOwner, lockIsOwned := thisLockServer.locks[lockCommand.LockName]
+	switch lockCommand.LockOp {
+	case Lock:
+		if thisLockServer.available(lockCommand.LockName, lockCommand.ClientID, false, lockCommand.Tree) &&
+			thisLockServer.inLine(lockCommand.LockName, lockCommand.ClientID) {
+			// The only client holding a lock shared can upgrade it
+			delete(thisLockServer.readers, lockCommand.LockName)
+			thisLockServer.leaveLine(lockCommand.LockName, lockCommand.ClientID)
+			result.Token = thisLockServer.grant(lockCommand.LockName, lockCommand.ClientID, lockCommand.TTLMillis, lockCommand.Tree)
+		} else if lockCommand.Wait {
+			thisLockServer.enqueue(lockCommand.LockName, lockWaiter{
+				ClientID:  lockCommand.ClientID,
+				TTLMillis: lockCommand.TTLMillis,
+				Tree:      lockCommand.Tree,
+			})
+			return nil
+		} else {
+			result.Err = ErrLockHeld
+		}
+	case Unlock:
+		if lockIsOwned && lockOwner == lockCommand.ClientID {
+			thisLockServer.notify(lockCommand.LockName, Released, lockCommand.ClientID)
+			thisLockServer.release(lockCommand.LockName)
+		} else {
+			result.Err = ErrInvalidUnlock
+		}
+	case RLock:
+		if lockIsOwned && lockOwner == lockCommand.ClientID {
+			// Holding a lock exclusively covers holding it shared
+			result.Token = thisLockServer.tokens[lockCommand.LockName]
+		} else if thisLockServer.available(lockCommand.LockName, lockCommand.ClientID, true, false) &&
+			thisLockServer.inLine(lockCommand.LockName, lockCommand.ClientID) {
+			// Readers do not get ahead of clients already waiting, so
+			// that a steady stream of them does not starve the others
+			thisLockServer.leaveLine(lockCommand.LockName, lockCommand.ClientID)
+			result.Token = thisLockServer.grantShared(lockCommand.LockName, lockCommand.ClientID)
+		} else if lockCommand.Wait {
+			thisLockServer.enqueue(lockCommand.LockName, lockWaiter{ClientID: lockCommand.ClientID, Shared: true})
+			return nil
+		} else {
+			result.Err = ErrLockHeld
+		}
+	case RUnlock:
+		if thisLockServer.readers[lockCommand.LockName][lockCommand.ClientID] {
+			thisLockServer.notify(lockCommand.LockName, Released, lockCommand.ClientID)
+			thisLockServer.releaseShared(lockCommand.LockName, lockCommand.ClientID)
+		} else {
+			result.Err = ErrInvalidUnlock
+		}
+	case List:
+		result.Holders = thisLockServer.list(lockCommand.LockName)
+	case OpenSession:
+		thisLockServer.sessions[lockCommand.ClientID] = thisLockServer.now + lockCommand.TTLMillis
+	case KeepAlive:
+		if _, open := thisLockServer.sessions[lockCommand.ClientID]; open {
+			thisLockServer.sessions[lockCommand.ClientID] = thisLockServer.now + lockCommand.TTLMillis
+		} else {
+			result.Err = ErrSessionExpired
+		}
+	case CloseSession:
+		if _, open := thisLockServer.sessions[lockCommand.ClientID]; open {
+			thisLockServer.endSession(lockCommand.ClientID, Released)
+		} else {
+			result.Err = ErrSessionExpired
+		}
+	default:
+		result.Err = ErrInvalidCommand
+	}
+	return encodeLockResult(result)
+}
+
+// Grants a lock to a client, or renews it if the client already holds
+// it. Returns the fencing token of the grant.
+func (thisLockServer *LockServer) grant(LockName string, ClientID int, TTLMillis int64, Tree bool) int64 {
+	if _, lockIsOwned := thisLockServer.locks[LockName]; !lockIsOwned {
+		thisLockServer.lastToken++
+		thisLockServer.tokens[LockName] = thisLockServer.lastToken
+		thisLockServer.notify(LockName, Acquired, ClientID)
+	}
+	thisLockServer.locks[LockName] = ClientID
+	// Locking again renews the lease, or makes the lock permanent
+	if TTLMillis > 0 {
+		thisLockServer.expiries[LockName] = thisLockServer.now + TTLMillis
+	} else {
+		delete(thisLockServer.expiries, LockName)
+	}
+	if Tree {
+		thisLockServer.trees[LockName] = true
+	} else {
+		delete(thisLockServer.trees, LockName)
+	}
+	return thisLockServer.tokens[LockName]
+}
+
+// Grants a lock shared to a client. Returns the fencing token of the
+// grant, which the clients holding the lock at the same time share.
+func (thisLockServer *LockServer) grantShared(LockName string, ClientID int) int64 {
+	if len(thisLockServer.readers[LockName]) == 0 {
+		thisLockServer.lastToken++
+		thisLockServer.tokens[LockName] = thisLockServer.lastToken
+		thisLockServer.readers[LockName] = make(map[int]bool)
+	}
+	if !thisLockServer.readers[LockName][ClientID] {
+		thisLockServer.notify(LockName, Acquired, ClientID)
+	}
+	thisLockServer.readers[LockName][ClientID] = true
+	return thisLockServer.tokens[LockName]
+}
+
+// Returns true if a client can get a lock right away, shared or not,
+// and as a tree or not
+func (thisLockServer *LockServer) available(LockName string, ClientID int, Shared bool, Tree bool) bool {
+	if owner, owned := thisLockServer.locks[LockName]; owned {
+		if owner != ClientID {
+			return false
+		}
+	} else if !Shared && !thisLockServer.onlyReader(LockName, ClientID) {
+		return false
+	}
+	// Locks of other clients above it that lock their tree, or below it
+	// if it would lock its tree
+	for lockName, owner := range thisLockServer.locks {
+		if owner != ClientID &&
+			(thisLockServer.trees[lockName] && below(LockName, lockName) || Tree && below(lockName, LockName)) {
+			return false
+		}
+	}
+	if Tree {
+		for lockName := range thisLockServer.readers {
+			if below(lockName, LockName) && !thisLockServer.onlyReader(lockName, ClientID) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the holders of the locks under a prefix, and of the prefix
+// itself. The empty prefix lists every lock.
+func (thisLockServer *LockServer) list(Prefix string) []LockHolder {
+	holders := make([]LockHolder, 0)
+	for lockName, owner := range thisLockServer.locks {
+		if under(lockName, Prefix) {
+			holders = append(holders, LockHolder{LockName: lockName, ClientID: owner})
+		}
+	}
+	for lockName, readers := range thisLockServer.readers {
+		if under(lockName, Prefix) {
+			for reader := range readers {
+				holders = append(holders, LockHolder{LockName: lockName, ClientID: reader, Shared: true})
+			}
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if holders[i].LockName != holders[j].LockName {
+			return holders[i].LockName < holders[j].LockName
+		}
+		return holders[i].ClientID < holders[j].ClientID
+	})
+	return holders
+}
+
+// Returns true if the lock is free, or only held shared by the client
+func (thisLockServer *LockServer) onlyReader(LockName string, ClientID int) bool {
+	readers := thisLockServer.readers[LockName]
+	return len(readers) == 0 || len(readers) == 1 && readers[ClientID]
+}
+
+// Returns true if a client that can have a lock would not get it ahead
+// of the clients waiting for it: nobody waits, the client is first in
+// line, or it holds the lock already
+func (thisLockServer *LockServer) inLine(LockName string, ClientID int) bool {
+	waiters := thisLockServer.waiters[LockName]
+	if len(waiters) == 0 || waiters[0].ClientID == ClientID {
+		return true
+	}
+	owner, owned := thisLockServer.locks[LockName]
+	return owned && owner == ClientID || thisLockServer.readers[LockName][ClientID]
+}
+
+// Takes a client that gets a lock out of the head of its queue, where
+// it was waiting for it
+func (thisLockServer *LockServer) leaveLine(LockName string, ClientID int) {
+	waiters := thisLockServer.waiters[LockName]
+	if len(waiters) == 0 || waiters[0].ClientID != ClientID {
+		return
+	}
+	if len(waiters) == 1 {
+		delete(thisLockServer.waiters, LockName)
+	} else {
+		thisLockServer.waiters[LockName] = waiters[1:]
+	}
+}
+
+// Queues a client for a lock held by someone else
+func (thisLockServer *LockServer) enqueue(LockName string, waiter lockWaiter) {
+	log.Printf("Client %d waits for lock %s\n", waiter.ClientID, LockName)
+	thisLockServer.waiters[LockName] = append(thisLockServer.waiters[LockName], waiter)
+}
+
+// Releases a lock held exclusively, or the last shared hold of a lock,
+// and grants it to the clients waiting for it in the order they asked
+// for it, for as long as they can have it. Clients waiting for the locks
+// above and below it can get them as well if it kept them from their
+// tree.
+func (thisLockServer *LockServer) release(LockName string) {
+	delete(thisLockServer.locks, LockName)
+	delete(thisLockServer.readers, LockName)
+	delete(thisLockServer.trees, LockName)
+	delete(thisLockServer.tokens, LockName)
+	delete(thisLockServer.expiries, LockName)
+	thisLockServer.grantWaiters(LockName)
+	// Sorted, so that every replica grants them in the same order
+	related := make([]string, 0)
+	for lockName := range thisLockServer.waiters {
+		if below(lockName, LockName) || below(LockName, lockName) {
+			related = append(related, lockName)
+		}
+	}
+	sort.Strings(related)
+	for _, lockName := range related {
+		thisLockServer.grantWaiters(lockName)
+	}
+}
+
+// Grants a lock to the clients at the head of its queue that can have it
+func (thisLockServer *LockServer) grantWaiters(LockName string) {
+	waiters := thisLockServer.waiters[LockName]
+	granted := 0
+	for granted < len(waiters) &&
+		thisLockServer.available(LockName, waiters[granted].ClientID, waiters[granted].Shared, waiters[granted].Tree) {
+		thisLockServer.grantWaiter(LockName, waiters[granted])
+		granted++
+	}
+	if granted == len(waiters) {
+		delete(thisLockServer.waiters, LockName)
+	} else {
+		thisLockServer.waiters[LockName] = waiters[granted:]
+	}
+}
+
+// Releases the shared hold of a client on a lock
+func (thisLockServer *LockServer) releaseShared(LockName string, ClientID int) {
+	delete(thisLockServer.readers[LockName], ClientID)
+	if len(thisLockServer.readers[LockName]) == 0 {
+		thisLockServer.release(LockName)
+	}
+}
+
+// Grants a lock to a client that was waiting for it, and completes its
+// wait
+func (thisLockServer *LockServer) grantWaiter(LockName string, waiter lockWaiter) {
+	var token int64
+	if waiter.Shared {
+		token = thisLockServer.grantShared(LockName, waiter.ClientID)
+	} else {
+		token = thisLockServer.grant(LockName, waiter.ClientID, waiter.TTLMillis, waiter.Tree)
+	}
+	log.Printf("Lock %s granted to waiting client %d\n", LockName, waiter.ClientID)
+	thisLockServer.completed[waiter.ClientID] = encodeLockResult(LockResult{Err: OK, Token: token})
+}
+
+// Ends the session of a client, stops its wait if it is waiting for a
+// lock, and releases every lock it holds. The releases are reported as
+// events of the given kind.
+func (thisLockServer *LockServer) endSession(ClientID int, Event EventKind) {
+	delete(thisLockServer.sessions, ClientID)
+	// Sorted, so that every replica grants the locks the client stops
+	// waiting for in the same order
+	queued := make([]string, 0, len(thisLockServer.waiters))
+	for lockName := range thisLockServer.waiters {
+		queued = append(queued, lockName)
+	}
+	sort.Strings(queued)
+	for _, lockName := range queued {
+		waiters := thisLockServer.waiters[lockName]
+		remaining := waiters[:0:0]
+		for _, waiter := range waiters {
+			if waiter.ClientID == ClientID {
+				thisLockServer.completed[ClientID] = encodeLockResult(LockResult{Err: ErrSessionExpired})
+			} else {
+				remaining = append(remaining, waiter)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(thisLockServer.waiters, lockName)
+		} else if len(remaining) < len(waiters) {
+			// The clients behind it may be able to get the lock now
+			thisLockServer.waiters[lockName] = remaining
+			thisLockServer.grantWaiters(lockName)
+		}
+	}
+	// In the order of their names, so that every replica grants them to
+	// the clients waiting for them in the same order
+	held := make([]string, 0)
+	for lockName, owner := range thisLockServer.locks {
+		if owner == ClientID {
+			held = append(held, lockName)
+		}
+	}
+	for lockName, readers := range thisLockServer.readers {
+		if readers[ClientID] {
+			held = append(held, lockName)
+		}
+	}
+	sort.Strings(held)
+	for _, lockName := range held {
+		thisLockServer.notify(lockName, Event, ClientID)
+		if thisLockServer.readers[lockName][ClientID] {
+			thisLockServer.releaseShared(lockName, ClientID)
+		} else {
+			thisLockServer.release(lockName)
+		}
+	}
+}
+
+// Records an event for the clients watching the lock
+func (thisLockServer *LockServer) notify(LockName string, Kind EventKind, ClientID int) {
+	thisLockServer.events = append(thisLockServer.events, Event{Name: LockName, Kind: Kind, ClientID: ClientID})
+}
+
+// Releases the locks whose lease expired, and those of the clients whose
+// session expired
+func (thisLockServer *LockServer) Tick(now int64) {
+	if now <= thisLockServer.now {
+		return
+	}
+	if thisLockServer.now == 0 {
+		// Leases and sessions granted before the first tick start with it
+		for lockName := range thisLockServer.expiries {
+			thisLockServer.expiries[lockName] += now
+		}
+		for clientID := range thisLockServer.sessions {
+			thisLockServer.sessions[clientID] += now
+		}
+	}
+	thisLockServer.now = now
+	// Expired in the order of their names, and of the client IDs, so that
+	// every replica grants the locks in the same order
+	expired := make([]string, 0)
+	for lockName, expiry := range thisLockServer.expiries {
+		if expiry <= now {
+			expired = append(expired, lockName)
+		}
+	}
+	sort.Strings(expired)
+	for _, lockName := range expired {
+		log.Printf("Lease of lock %s held by %d expired\n", lockName, thisLockServer.locks[lockName])
+		thisLockServer.notify(lockName, Expired, thisLockServer.locks[lockName])
+		thisLockServer.release(lockName)
+	}
+	expiredSessions := make([]int, 0)
+	for clientID, expiry := range thisLockServer.sessions {
+		if expiry <= now {
+			expiredSessions = append(expiredSessions, clientID)
+		}
+	}
+	sort.Ints(expiredSessions)
+	for _, clientID := range expiredSessions {
+		log.Printf("Session of client %d expired\n", clientID)
+		thisLockServer.endSession(clientID, Expired)
+	}
+}
+
+func (thisLockServer *LockServer) NeedsTicks() bool {
+	return len(thisLockServer.expiries) > 0 || len(thisLockServer.sessions) > 0
+}
+
+func (thisLockServer *LockServer) Completed() map[int][]byte {
+	completed := thisLockServer.completed
+	thisLockServer.completed = make(map[int][]byte)
+	return completed
+}
+
+// Answers a List without deciding it, the result is a LockResult
+func (thisLockServer *LockServer) Query(query []byte) []byte {
+	var lockCommand LockCommand
+	if err := decodeRecord(query, &lockCommand); err != nil || lockCommand.LockOp != List {
+		return encodeLockResult(LockResult{Err: ErrInvalidCommand})
+	}
+	return encodeLockResult(LockResult{Err: OK, Holders: thisLockServer.list(lockCommand.LockName)})
+}
+
+func (thisLockServer *LockServer) Events() []Event {
+	events := thisLockServer.events
+	thisLockServer.events = nil
+	return events
+}
+
+func (thisLockServer *LockServer) Snapshot() []byte {
+	state := lockServerState{
+		Locks:     thisLockServer.locks,
+		Readers:   thisLockServer.readers,
+		Trees:     thisLockServer.trees,
+		Tokens:    thisLockServer.tokens,
+		LastToken: thisLockServer.lastToken,
+		Expiries:  thisLockServer.expiries,
+		Sessions:  thisLockServer.sessions,
+		Waiters:   thisLockServer.waiters,
+		Now:       thisLockServer.now,
+	}
+	snapshot, err := encodeRecord(state)
+	if err != nil {
+		log.Fatalf("Failed to encode lock server state %+v, %s\n", state, err)
+	}
+	return snapshot
+}
+
+func (thisLockServer *LockServer) Restore(snapshot []byte) error {
+	var state lockServerState
+	if err := decodeRecord(snapshot, &state); err != nil {
+		return err
+	}
+	thisLockServer.locks = state.Locks
+	thisLockServer.readers = state.Readers
+	thisLockServer.trees = state.Trees
+	thisLockServer.tokens = state.Tokens
+	thisLockServer.lastToken = state.LastToken
+	thisLockServer.expiries = state.Expiries
+	thisLockServer.sessions = state.Sessions
+	thisLockServer.waiters = state.Waiters
+	thisLockServer.completed = make(map[int][]byte)
+	thisLockServer.events = nil
+	thisLockServer.now = state.Now
+	if thisLockServer.locks == nil {
+		thisLockServer.locks = make(map[string]int)
+	}
+	if thisLockServer.readers == nil {
+		thisLockServer.readers = make(map[string]map[int]bool)
+	}
+	if thisLockServer.trees == nil {
+		thisLockServer.trees = make(map[string]bool)
+	}
+	if thisLockServer.tokens == nil {
+		thisLockServer.tokens = make(map[string]int64)
+	}
+	if thisLockServer.expiries == nil {
+		thisLockServer.expiries = make(map[string]int64)
+	}
+	if thisLockServer.sessions == nil {
+		thisLockServer.sessions = make(map[int]int64)
+	}
+	if thisLockServer.waiters == nil {
+		thisLockServer.waiters = make(map[string][]lockWaiter)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package lspaxos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/rpc"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Number of messages a direction of an in-memory connection buffers
+	memoryConnectionBufferSize = 16
+)
+
+// Transport that keeps every message inside the process, so that a whole
+// cluster can run in one process without opening any ports. Messages go
+// over channels, and are gob encoded on the way like over TCP, so that
+// the sender and the server never share memory.
+type MemoryTransport struct {
+	// Connections to the servers the transport sends to
+	pool *connectionPool
+
+	// Lock to control access to the servers map and nextAddress
+	mu sync.Mutex
+
+	// Servers of the transport, keyed by address
+	servers map[string]*memoryServer
+
+	// Number used in the next address picked by the transport
+	nextAddress int
+}
+
+// A server of a MemoryTransport
+type memoryServer struct {
+	server *rpc.Server
+
+	// Connections of the peers to the server
+	connections serverConnections
+}
+
+// A message of an in-memory connection, either a request or a response
+type memoryMessage struct {
+	ServiceMethod string
+
+	// Matches a response with its request
+	Seq uint64
+
+	// Error returned by the handler, responses only
+	Error string
+
+	// Gob encoded request or response
+	Body []byte
+}
+
+// An in-memory connection between a sender and a server
+type memoryConnection struct {
+	requests chan memoryMessage
+
+	responses chan memoryMessage
+
+	// Closed when either end closes the connection
+	closed chan bool
+
+	closeOnce sync.Once
+}
+
+func (connection *memoryConnection) Close() error {
+	connection.closeOnce.Do(func() { close(connection.closed) })
+	return nil
+}
+
+// Sends a message to the other end, fails if the connection is closed
+func (connection *memoryConnection) send(messages chan memoryMessage, message memoryMessage) error {
+	select {
+	case <-connection.closed:
+		return io.EOF
+	default:
+	}
+	select {
+	case messages <- message:
+		return nil
+	case <-connection.closed:
+		return io.EOF
+	}
+}
+
+// Receives a message from the other end, fails if the connection is closed
+func (connection *memoryConnection) receive(messages chan memoryMessage) (message memoryMessage, err error) {
+	select {
+	case message = <-messages:
+		return message, nil
+	case <-connection.closed:
+		return message, io.EOF
+	}
+}
+
+// Decodes a message body, unless net/rpc asks for it to be discarded
+func decodeBody(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return decodeRecord(data, body)
+}
+
+// The server end of an in-memory connection, for rpc.ServeCodec
+type memoryServerCodec struct {
+	*memoryConnection
+
+	// Request whose header was read, and whose body is read next
+	request memoryMessage
+}
+
+func (codec *memoryServerCodec) ReadRequestHeader(request *rpc.Request) (err error) {
+	if codec.request, err = codec.receive(codec.requests); err != nil {
+		return err
+	}
+	request.ServiceMethod = codec.request.ServiceMethod
+	request.Seq = codec.request.Seq
+	return nil
+}
+
+func (codec *memoryServerCodec) ReadRequestBody(body interface{}) error {
+	return decodeBody(codec.request.Body, body)
+}
+
+func (codec *memoryServerCodec) WriteResponse(response *rpc.Response, body interface{}) (err error) {
+	message := memoryMessage{ServiceMethod: response.ServiceMethod, Seq: response.Seq, Error: response.Error}
+	if response.Error == "" {
+		if message.Body, err = encodeRecord(body); err != nil {
+			return err
+		}
+	}
+	return codec.send(codec.responses, message)
+}
+
+// The sender end of an in-memory connection, for rpc.NewClientWithCodec
+type memoryClientCodec struct {
+	*memoryConnection
+
+	// Response whose header was read, and whose body is read next
+	response memoryMessage
+}
+
+func (codec *memoryClientCodec) WriteRequest(request *rpc.Request, body interface{}) (err error) {
+	message := memoryMessage{ServiceMethod: request.ServiceMethod, Seq: request.Seq}
+	if message.Body, err = encodeRecord(body); err != nil {
+		return err
+	}
+	return codec.send(codec.requests, message)
+}
+
+func (codec *memoryClientCodec) ReadResponseHeader(response *rpc.Response) (err error) {
+	if codec.response, err = codec.receive(codec.responses); err != nil {
+		return err
+	}
+	response.ServiceMethod = codec.response.ServiceMethod
+	response.Seq = codec.response.Seq
+	response.Error = codec.response.Error
+	return nil
+}
+
+func (codec *memoryClientCodec) ReadResponseBody(body interface{}) error {
+	return decodeBody(codec.response.Body, body)
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	transport := &MemoryTransport{servers: make(map[string]*memoryServer)}
+	transport.pool = newConnectionPool(transport.connect)
+	return transport
+}
+
+// Opens a connection to the server at the address
+func (transport *MemoryTransport) connect(ctx context.Context, address string) (*rpc.Client, error) {
+	transport.mu.Lock()
+	memoryServer, present := transport.servers[address]
+	transport.mu.Unlock()
+	if !present {
+		return nil, errors.New("No server at " + address)
+	}
+	connection := &memoryConnection{
+		requests:  make(chan memoryMessage, memoryConnectionBufferSize),
+		responses: make(chan memoryMessage, memoryConnectionBufferSize),
+		closed:    make(chan bool),
+	}
+	serverCodec := &memoryServerCodec{memoryConnection: connection}
+	go memoryServer.connections.serve(connection, func() { memoryServer.server.ServeCodec(serverCodec) })
+	return rpc.NewClientWithCodec(&memoryClientCodec{memoryConnection: connection}), nil
+}
+
+func (transport *MemoryTransport) Send(Ctx context.Context, Address string, ProcedureName string, Request interface{}, Response interface{}) error {
+	return transport.pool.send(Ctx, Address, ProcedureName, Request, Response)
+}
+
+func (transport *MemoryTransport) Serve(Address string, Receiver interface{}) (string, error) {
+	server := rpc.NewServer()
+	if err := server.Register(Receiver); err != nil {
+		return "", err
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if _, present := transport.servers[Address]; present {
+		return "", errors.New("Already serving at " + Address)
+	}
+	// Skip the addresses servers were given explicitly
+	for Address == "" || transport.servers[Address] != nil {
+		transport.nextAddress++
+		Address = "memory:" + strconv.Itoa(transport.nextAddress)
+	}
+	transport.servers[Address] = &memoryServer{server: server}
+	return Address, nil
+}
+
+func (transport *MemoryTransport) Close(Address string) error {
+	transport.mu.Lock()
+	memoryServer, present := transport.servers[Address]
+	delete(transport.servers, Address)
+	transport.mu.Unlock()
+	if !present {
+		return errors.New("Not serving at " + Address)
+	}
+	memoryServer.connections.close()
+	return nil
+}
@@ -0,0 +1,244 @@
+package lspaxos
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protobuf encoding of the messages of the gRPC services in lspaxos.proto.
+// Only the few wire types these messages use are supported, and fields
+// holding their default value are left out, as in proto3.
+
+const (
+	protoVarint          = 0
+	protoFixed64         = 1
+	protoLengthDelimited = 2
+	protoFixed32         = 5
+)
+
+var errProtoTruncated = errors.New("Truncated protobuf message")
+
+// Builds a protobuf message field by field
+type protoWriter struct {
+	data []byte
+}
+
+func (writer *protoWriter) tag(field int, wireType int) {
+	writer.data = binary.AppendUvarint(writer.data, uint64(field)<<3|uint64(wireType))
+}
+
+func (writer *protoWriter) int64(field int, value int64) {
+	if value != 0 {
+		writer.tag(field, protoVarint)
+		writer.data = binary.AppendUvarint(writer.data, uint64(value))
+	}
+}
+
+func (writer *protoWriter) bool(field int, value bool) {
+	if value {
+		writer.int64(field, 1)
+	}
+}
+
+func (writer *protoWriter) bytes(field int, value []byte) {
+	if len(value) > 0 {
+		writer.message(field, value)
+	}
+}
+
+func (writer *protoWriter) string(field int, value string) {
+	writer.bytes(field, []byte(value))
+}
+
+// Repeated strings are written even if empty, to keep their position
+func (writer *protoWriter) strings(field int, values []string) {
+	for _, value := range values {
+		writer.message(field, []byte(value))
+	}
+}
+
+// Writes an encoded message, even if empty, since it is present
+func (writer *protoWriter) message(field int, message []byte) {
+	writer.tag(field, protoLengthDelimited)
+	writer.data = binary.AppendUvarint(writer.data, uint64(len(message)))
+	writer.data = append(writer.data, message...)
+}
+
+// Reads a protobuf message field by field
+type protoReader struct {
+	data []byte
+
+	// Wire type of the field being read
+	wireType int
+}
+
+// Reads the tag of the next field. Returns false at the end of the
+// message.
+func (reader *protoReader) next() (field int, more bool, err error) {
+	if len(reader.data) == 0 {
+		return 0, false, nil
+	}
+	tag, err := reader.uvarint()
+	if err != nil {
+		return 0, false, err
+	}
+	reader.wireType = int(tag & 7)
+	return int(tag >> 3), true, nil
+}
+
+func (reader *protoReader) uvarint() (value uint64, err error) {
+	value, length := binary.Uvarint(reader.data)
+	if length <= 0 {
+		return 0, errProtoTruncated
+	}
+	reader.data = reader.data[length:]
+	return value, nil
+}
+
+func (reader *protoReader) int64() (value int64, err error) {
+	if reader.wireType != protoVarint {
+		return 0, errors.New("Expected a varint field")
+	}
+	unsigned, err := reader.uvarint()
+	return int64(unsigned), err
+}
+
+func (reader *protoReader) bool() (value bool, err error) {
+	unsigned, err := reader.int64()
+	return unsigned != 0, err
+}
+
+func (reader *protoReader) bytes() (value []byte, err error) {
+	if reader.wireType != protoLengthDelimited {
+		return nil, errors.New("Expected a length-delimited field")
+	}
+	length, err := reader.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(reader.data)) < length {
+		return nil, errProtoTruncated
+	}
+	value = reader.data[:length:length]
+	reader.data = reader.data[length:]
+	return value, nil
+}
+
+func (reader *protoReader) string() (value string, err error) {
+	data, err := reader.bytes()
+	return string(data), err
+}
+
+// Skips a field the message does not know about
+func (reader *protoReader) skip() (err error) {
+	switch reader.wireType {
+	case protoVarint:
+		_, err = reader.uvarint()
+	case protoLengthDelimited:
+		_, err = reader.bytes()
+	case protoFixed64, protoFixed32:
+		size := 8
+		if reader.wireType == protoFixed32 {
+			size = 4
+		}
+		if len(reader.data) < size {
+			return errProtoTruncated
+		}
+		reader.data = reader.data[size:]
+	default:
+		err = errors.New("Unsupported protobuf wire type")
+	}
+	return err
+}
+
+// Calls read with the number of every field of the message, which
+// reads the field if it knows it. Fields it does not know are skipped.
+func readProto(data []byte, read func(reader *protoReader, field int) (known bool, err error)) (err error) {
+	reader := &protoReader{data: data}
+	for {
+		field, more, err := reader.next()
+		if err != nil || !more {
+			return err
+		}
+		known, err := read(reader, field)
+		if err != nil {
+			return err
+		}
+		if !known {
+			if err = reader.skip(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func unmarshalLockCommand(data []byte) (lockCommand LockCommand, err error) {
+	err = readProto(data, func(reader *protoReader, field int) (bool, error) {
+		var value string
+		var number int64
+		var err error
+		switch field {
+		case 1:
+			lockCommand.LockName, err = reader.string()
+		case 2:
+			value, err = reader.string()
+			lockCommand.LockOp = LockOp(value)
+		case 3:
+			number, err = reader.int64()
+			lockCommand.ClientID = int(number)
+		case 4:
+			lockCommand.TTLMillis, err = reader.int64()
+		case 5:
+			lockCommand.Wait, err = reader.bool()
+		case 6:
+			lockCommand.Tree, err = reader.bool()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return lockCommand, err
+}
+
+// Message id of a LockRequest, and its decoded operation
+func unmarshalLockRequest(data []byte) (msgID int, lockCommand LockCommand, err error) {
+	err = readProto(data, func(reader *protoReader, field int) (bool, error) {
+		var value []byte
+		var number int64
+		var err error
+		switch field {
+		case 1:
+			if value, err = reader.bytes(); err == nil {
+				lockCommand, err = unmarshalLockCommand(value)
+			}
+		case 2:
+			number, err = reader.int64()
+			msgID = int(number)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return msgID, lockCommand, err
+}
+
+func marshalLockHolder(holder LockHolder) []byte {
+	var writer protoWriter
+	writer.string(1, holder.LockName)
+	writer.int64(2, int64(holder.ClientID))
+	writer.bool(3, holder.Shared)
+	return writer.data
+}
+
+// Encodes a LockResponse from what the replica answered for the operation
+func marshalLockResponse(response ClientResponse, result LockResult) []byte {
+	var writer protoWriter
+	writer.string(1, string(result.Err))
+	writer.int64(2, int64(response.MsgID))
+	writer.int64(3, result.Token)
+	for _, holder := range result.Holders {
+		writer.message(4, marshalLockHolder(holder))
+	}
+	writer.strings(5, response.Replicas)
+	return writer.data
+}
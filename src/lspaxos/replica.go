@@ -1,16 +1,50 @@
 package lspaxos
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
-	"net"
-	"net/rpc"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	ReplicaResponsesChannelSize = 512
+
+	// Name of the replica's log inside its data directory
+	replicaLogName = "replica.log"
+
+	// Name of the replica's snapshot inside its data directory
+	replicaSnapshotName = "replica.snapshot"
+
+	// Number of applied slots after which the replica snapshots its state
+	replicaSnapshotInterval = 100
+
+	// How often replicas check which slots can be garbage collected
+	compactionIntervalMillis = 1000
+
+	// How often replicas propose a tick while the state machine needs them
+	tickIntervalMillis = 100
+
+	// Number of slots a replica can fall behind before it is sent a snapshot
+	replicaSnapshotLag = 1000
+
+	// Size of the chunks a snapshot is sent in
+	replicaSnapshotChunkSize = 64 * 1024
+
+	// Window of a configuration that does not set one
+	defaultWindow = 5
+
+	// How long a replica tries to answer a query
+	queryTimeoutMillis = 5000
+
+	// Number of recent events of the state machine a replica keeps for
+	// the clients watching them
+	watchHistory = 1000
 )
 
 type Replica struct {
@@ -24,8 +58,17 @@ type Replica struct {
 	// Unique identifier of the replica
 	replicaID int
 
-	// Map from lock name to client holding it
-	lockMap map[string]int
+	// State machine the decided commands are applied to
+	stateMachine StateMachine
+
+	// Map from client to the result of the latest command applied for it.
+	// Clients issue one command at a time with increasing message ids, so
+	// a command with a message id up to the recorded one was applied
+	// already and must not be applied again. It has one entry per client
+	// id ever seen, which is never dropped since a client may come back
+	// with a retry at any time, so client ids are meant to be reused
+	// (a restarted client keeps its id) rather than picked at random.
+	clientResults map[int]clientResult
 
 	// The index of the next slot in which the replica
 	// has not yet proposed any command, initially 1
@@ -47,14 +90,56 @@ type Replica struct {
 	// Condition variable for when command is performed
 	somethingPerformed sync.Cond
 
-	// Proposals that are known to have been decided
+	// Proposals that are known to have been decided, but not yet performed
 	decisions map[int]Command
 
-	// Leaders
-	leaders []string
+	// Configurations by the first slot they are in force at
+	configs map[int]Configuration
+
+	// Set while a replica that joined the cluster waits for a snapshot
+	joining bool
+
+	// Slot below which the replica asked the leaders to garbage collect
+	compactedSlot int
+
+	// Highest slot a query waits for the replica to apply. Slots up to
+	// it that the replica did not learn about are filled like gaps.
+	readIndex int
+
+	// Durable log of the decisions applied to the state machine, nil if
+	// the replica was started without a data directory
+	wal *writeAheadLog
+
+	// Path of the snapshot of the state machine, next to the log
+	snapshotPath string
+
+	// Slot at which the last snapshot was taken
+	snapshotSlot int
+
+	// Number of applied slots after which to take a new snapshot
+	snapshotInterval int
+
+	// Number of slots a peer can fall behind before it is sent a snapshot
+	snapshotLag int
+
+	// Size of the chunks a snapshot is sent in
+	snapshotChunkSize int
 
-	// Listener
-	listener net.Listener
+	// Snapshots being received, by the ID of the replica sending them
+	incomingSnapshots map[int][]byte
+
+	// Recent events of the state machine, in slot order
+	events []Event
+
+	// Slot up to which the events were dropped, watches that did not
+	// get them have missed some
+	eventsSince int
+
+	// Carries the RPCs of the replica
+	transport Transport
+
+	// gRPC endpoints of the replica, see ServeGRPC
+	grpcServers []*http.Server
 
 	// Address
 	Address string
@@ -63,37 +148,264 @@ type Replica struct {
 	dead int32
 }
 
+// Record written to the replica's log for every decision it applies
+type replicaRecord struct {
+	Slot int
+
+	Command Command
+}
+
+// Result of a command applied for a client
+type clientResult struct {
+	MsgID int
+
+	Result []byte
+
+	// Set while the state machine has not completed the command yet
+	Pending bool
+}
+
+// State of the replica at a slot. Replaces the log of all the
+// decisions applied before that slot.
+type replicaSnapshot struct {
+	// Next slot to apply on top of the snapshot
+	SlotOut int
+
+	// State machine snapshot
+	State []byte
+
+	ClientResults map[int]clientResult
+
+	Configs map[int]Configuration
+}
+
+// Returns the configuration a slot is decided under, and the first slot
+// that configuration is in force at
+// Must be called with the lock held
+func (thisReplica *Replica) configAt(slot int) (configSlot int, config Configuration) {
+	configSlot = -1
+	for start, candidate := range thisReplica.configs {
+		if start <= slot && start > configSlot {
+			configSlot = start
+			config = candidate
+		}
+	}
+	return configSlot, config
+}
+
+// Tells if a command was already applied, in which case its result is
+// the one in clientResults, or it was superseded by a newer command
+// Must be called with the lock held
+func (thisReplica *Replica) performed(command Command) bool {
+	result, present := thisReplica.clientResults[command.ClientID]
+	return present && result.MsgID >= command.MsgID
+}
+
+// Tells if a command is waiting to be proposed or being decided
+// Must be called with the lock held
+func (thisReplica *Replica) pending(command Command) bool {
+	for _, request := range thisReplica.requests {
+		if command.Equals(request) {
+			return true
+		}
+	}
+	for _, proposal := range thisReplica.proposals {
+		if command.Equals(proposal) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first slot the replica can't propose in yet. A slot is only
+// proposed in once every reconfiguration that can change the configuration
+// it is decided under was applied, which also bounds the number of slots
+// being decided at once.
+// Must be called with the lock held
+func (thisReplica *Replica) windowEnd() int {
+	currentSlot, _ := thisReplica.configAt(thisReplica.slotOut)
+	end := -1
+	for start, config := range thisReplica.configs {
+		if start < currentSlot {
+			continue
+		}
+		// The earliest slot this configuration can decide a
+		// reconfiguration in, that is not applied yet
+		first := start
+		if first < thisReplica.slotOut {
+			first = thisReplica.slotOut
+		}
+		if end < 0 || first+config.window() < end {
+			end = first + config.window()
+		}
+	}
+	return end
+}
+
+// Forgets the configurations no slot from slotOut on is decided under
+// Must be called with the lock held
+func (thisReplica *Replica) retireConfigs() {
+	currentSlot, _ := thisReplica.configAt(thisReplica.slotOut)
+	for start := range thisReplica.configs {
+		if start < currentSlot {
+			delete(thisReplica.configs, start)
+		}
+	}
+}
+
+// Sends a proposal for a slot to every leader
+// Must be called with the lock held
+func (thisReplica *Replica) sendProposal(slot int, command Command) {
+	configSlot, config := thisReplica.configAt(slot)
+	request := ReplicaRequest{
+		Command:    command,
+		Slot:       slot,
+		ConfigSlot: configSlot,
+		Acceptors:  config.Acceptors,
+	}
+	for _, leader := range config.Leaders {
+		go thisReplica.retransmitProposal(leader, request)
+	}
+	thisReplica.proposals[slot] = command
+}
+
+// Sends a proposal to a leader until the leader answers, the slot is
+// decided or the replica is killed. Nothing else proposes the command
+// again while its slot is pending, so giving up on the leaders (e.g. while
+// they all restart) would leave the client waiting for good.
+func (thisReplica *Replica) retransmitProposal(leader string, request ReplicaRequest) {
+	for !thisReplica.isDead() && thisReplica.proposing(request.Slot, request.Command) {
+		response := new(ReplicaResponse)
+		done := make(chan interface{}, 1)
+		CallWithRetries(
+			context.Background(),
+			thisReplica.transport,
+			leader,
+			"Leader.ExecutePropose",
+			request,
+			response,
+			done,
+		)
+		if result := <-done; result != false {
+			thisReplica.replicaResponses <- result
+			return
+		}
+		time.Sleep(retransmitMaxMillis * time.Millisecond)
+	}
+}
+
+// Tells if the command proposed in a slot is still waiting for its
+// decision
+func (thisReplica *Replica) proposing(slot int, command Command) bool {
+	thisReplica.mu.Lock()
+	defer thisReplica.mu.Unlock()
+	proposal, proposed := thisReplica.proposals[slot]
+	return proposed && proposal.Equals(command)
+}
+
 func (thisReplica *Replica) propose() {
 	for {
 		thisReplica.mu.Lock()
 		log.Printf("Replica %d has proposals %+v\n", thisReplica.replicaID, thisReplica.proposals)
-		for len(thisReplica.requests) == 0 {
+		for len(thisReplica.requests) == 0 ||
+			thisReplica.slotIn >= thisReplica.windowEnd() ||
+			thisReplica.joining {
 			thisReplica.newRequest.Wait()
 		}
-		// Propose values. Should empty out the Requests
-		for _, requestCommand := range thisReplica.requests {
-			request := ReplicaRequest{
-				Command: requestCommand,
-				Slot:    thisReplica.slotIn,
+		// Propose values until the Requests are empty or the window is full
+		for len(thisReplica.requests) > 0 && thisReplica.slotIn < thisReplica.windowEnd() {
+			if thisReplica.performed(thisReplica.requests[0]) {
+				// Decided in another slot in the meantime
+				thisReplica.requests = thisReplica.requests[1:]
+				continue
 			}
-			for _, leader := range thisReplica.leaders {
-				response := new(ReplicaResponse)
-				go Call(
-					leader,
-					"Leader.ExecutePropose",
-					request,
-					response,
-					thisReplica.replicaResponses,
-				)
+			// Skip slots we already learned the decision of, or filled
+			_, decided := thisReplica.decisions[thisReplica.slotIn]
+			_, proposed := thisReplica.proposals[thisReplica.slotIn]
+			if decided || proposed {
+				thisReplica.slotIn++
+				continue
 			}
-			thisReplica.proposals[thisReplica.slotIn] = requestCommand
+			thisReplica.sendProposal(thisReplica.slotIn, thisReplica.requests[0])
+			thisReplica.requests = thisReplica.requests[1:]
 			thisReplica.slotIn++
 		}
-		thisReplica.requests = nil
 		thisReplica.mu.Unlock()
 	}
 }
 
+// Applies a command decided in a slot to the state machine (or the
+// configurations) and records its result
+// Must be called with the lock held
+func (thisReplica *Replica) execute(slot int, command Command) {
+	if thisReplica.performed(command) {
+		// The command was decided in an earlier slot too, e.g. because
+		// a replica proposed it again after it seemed to lose its slot
+		log.Printf("Replica %d skipping duplicate %+v in slot %d\n", thisReplica.replicaID, command, slot)
+		return
+	}
+	var result []byte
+	switch command.Kind {
+	case Reconfigure:
+		_, config := thisReplica.configAt(slot)
+		log.Printf("Replica %d configuration %+v in force from slot %d\n", thisReplica.replicaID, *command.Config, slot+config.window())
+		thisReplica.configs[slot+config.window()] = *command.Config
+	case Operation:
+		result = thisReplica.stateMachine.Apply(command.Op)
+	case Tick:
+		if clocked, ok := thisReplica.stateMachine.(Clocked); ok {
+			clocked.Tick(command.Time)
+		}
+	}
+	_, deferred := thisReplica.stateMachine.(Deferred)
+	thisReplica.clientResults[command.ClientID] = clientResult{
+		MsgID:   command.MsgID,
+		Result:  result,
+		Pending: deferred && command.Kind == Operation && result == nil,
+	}
+	thisReplica.collectCompleted()
+	thisReplica.collectEvents(slot)
+}
+
+// Records the results of the commands the state machine completed in
+// the slot that was just applied
+// Must be called with the lock held
+func (thisReplica *Replica) collectCompleted() {
+	deferred, ok := thisReplica.stateMachine.(Deferred)
+	if !ok {
+		return
+	}
+	for clientID, result := range deferred.Completed() {
+		if latest, present := thisReplica.clientResults[clientID]; present && latest.Pending {
+			thisReplica.clientResults[clientID] = clientResult{MsgID: latest.MsgID, Result: result}
+		}
+	}
+}
+
+// Records the events of the slot that was just applied, for the clients
+// watching them
+// Must be called with the lock held
+func (thisReplica *Replica) collectEvents(slot int) {
+	watched, ok := thisReplica.stateMachine.(Watched)
+	if !ok {
+		return
+	}
+	for _, event := range watched.Events() {
+		event.Slot = slot
+		thisReplica.events = append(thisReplica.events, event)
+	}
+	if len(thisReplica.events) <= 2*watchHistory {
+		return
+	}
+	// Drop whole slots, watches resume after a slot
+	dropped := len(thisReplica.events) - watchHistory
+	for dropped < len(thisReplica.events) && thisReplica.events[dropped].Slot == thisReplica.events[dropped-1].Slot {
+		dropped++
+	}
+	thisReplica.eventsSince = thisReplica.events[dropped-1].Slot
+	thisReplica.events = append([]Event(nil), thisReplica.events[dropped:]...)
+}
+
 func (thisReplica *Replica) perform() {
 	for {
 		response := <-thisReplica.replicaResponses
@@ -103,89 +415,671 @@ func (thisReplica *Replica) perform() {
 		replicaResponse := response.(*ReplicaResponse)
 		log.Printf("Replica %d got a response %+v\n", thisReplica.replicaID, replicaResponse)
 		thisReplica.mu.Lock()
+		if replicaResponse.Err == ErrCompacted {
+			// Every other replica is past this slot, one of them
+			// will send us a snapshot
+			log.Printf("Replica %d is behind the compacted slots at slot %d\n", thisReplica.replicaID, replicaResponse.Slot)
+			thisReplica.mu.Unlock()
+			continue
+		}
+		if replicaResponse.Slot < thisReplica.slotOut {
+			// Already performed, e.g. learned while catching up
+			thisReplica.mu.Unlock()
+			continue
+		}
 		thisReplica.decisions[replicaResponse.Slot] = replicaResponse.Command
 		decidedCommand, present := thisReplica.decisions[thisReplica.slotOut]
 		for present {
+			// The decision has to be durable before it is applied
+			record := replicaRecord{Slot: thisReplica.slotOut, Command: decidedCommand}
+			if err := thisReplica.persist(record); err != nil {
+				log.Printf("Replica %d failed to persist slot %d, %s\n", thisReplica.replicaID, thisReplica.slotOut, err)
+				break
+			}
 			thisReplica.somethingPerformed.Broadcast()
-			proposedCommand := thisReplica.proposals[thisReplica.slotOut]
+			proposedCommand, proposed := thisReplica.proposals[thisReplica.slotOut]
 			delete(thisReplica.proposals, thisReplica.slotOut)
-			if !decidedCommand.Equals(proposedCommand) {
+			if proposed &&
+				!decidedCommand.Equals(proposedCommand) &&
+				proposedCommand.fromClient() &&
+				!thisReplica.performed(proposedCommand) {
 				thisReplica.requests = append(thisReplica.requests, proposedCommand)
 				thisReplica.newRequest.Signal()
 			}
-			lockOwner, lockIsOwned := thisReplica.lockMap[decidedCommand.LockName]
-			switch decidedCommand.LockOp {
-			case Lock:
-				if !lockIsOwned || lockOwner == decidedCommand.ClientID {
-					thisReplica.lockMap[decidedCommand.LockName] = decidedCommand.ClientID
-				}
-			case Unlock:
-				if lockIsOwned && lockOwner == decidedCommand.ClientID {
-					delete(thisReplica.lockMap, decidedCommand.LockName)
-				}
-			}
+			thisReplica.execute(thisReplica.slotOut, decidedCommand)
+			delete(thisReplica.decisions, thisReplica.slotOut)
 			thisReplica.slotOut++
 			decidedCommand, present = thisReplica.decisions[thisReplica.slotOut]
 		}
+		if thisReplica.slotIn < thisReplica.slotOut {
+			thisReplica.slotIn = thisReplica.slotOut
+		}
+		thisReplica.retireConfigs()
+		thisReplica.fillGaps()
+		// The window moved, there may be room for more proposals
+		thisReplica.newRequest.Signal()
+		if thisReplica.wal != nil && thisReplica.slotOut-thisReplica.snapshotSlot >= thisReplica.snapshotInterval {
+			thisReplica.takeSnapshot()
+		}
 		thisReplica.mu.Unlock()
 	}
 }
 
+// Handler for client requests
+// A command that was applied already is answered with its recorded
+// result, and one that is already being decided is not proposed again,
+// so a client can retry a request as often as it wants
 func (thisReplica *Replica) ExecuteRequest(req ClientRequest, res *ClientResponse) (err error) {
-	// TODO: Check for duplicate req in Requests, Proposals, Decisions
-	// This is impossible
+	return thisReplica.executeRequest(context.Background(), req, res)
+}
+
+// ExecuteRequest, except that it stops waiting for the command once Ctx
+// is done, and returns the error of Ctx. The command is still applied,
+// and a retry gets its result.
+func (thisReplica *Replica) executeRequest(Ctx context.Context, req ClientRequest, res *ClientResponse) (err error) {
 	log.Printf("Replica %d got a request %+v\n", thisReplica.replicaID, req.Command)
 	res.MsgID = req.Command.MsgID
-	requestDecided := false
+	// Every replica applies a decided configuration, so one that can't be
+	// applied must never be proposed
+	if req.Command.Kind == Reconfigure && (req.Command.Config == nil || !req.Command.Config.complete()) {
+		res.Err = ErrInvalidConfig
+		return nil
+	}
 	thisReplica.mu.Lock()
-	thisReplica.requests = append(thisReplica.requests, req.Command)
-	thisReplica.mu.Unlock()
-	thisReplica.newRequest.Signal()
+	defer thisReplica.mu.Unlock()
+	if !thisReplica.performed(req.Command) && !thisReplica.pending(req.Command) {
+		thisReplica.requests = append(thisReplica.requests, req.Command)
+		thisReplica.newRequest.Signal()
+	}
 
-	for !requestDecided {
+	// perform() records the result of every command it applies,
+	// so wait until it got to this one, and the state machine completed it
+	stop := context.AfterFunc(Ctx, func() {
 		thisReplica.mu.Lock()
+		thisReplica.somethingPerformed.Broadcast()
+		thisReplica.mu.Unlock()
+	})
+	defer stop()
+	result, performed := thisReplica.clientResults[req.Command.ClientID]
+	for !performed ||
+		result.MsgID < req.Command.MsgID ||
+		(result.MsgID == req.Command.MsgID && result.Pending) {
+		if Ctx.Err() != nil {
+			return Ctx.Err()
+		}
 		thisReplica.somethingPerformed.Wait()
-		localLockMap := make(map[string]int)
-		var logState = fmt.Sprintf("Replica %d state:", thisReplica.replicaID)
-		for slot := 0; slot < thisReplica.slotOut; slot++ {
-			decidedCommand := thisReplica.decisions[slot]
-			var result Err = ErrConnectionError
-			lockOwner, lockIsOwned := localLockMap[decidedCommand.LockName]
-			switch decidedCommand.LockOp {
-			case Lock:
-				if !lockIsOwned || lockOwner == decidedCommand.ClientID {
-					localLockMap[decidedCommand.LockName] = decidedCommand.ClientID
-					result = OK
-					logState += fmt.Sprintf(" (%d %+v)", slot, decidedCommand)
-				} else {
-					result = ErrLockHeld
-				}
-			case Unlock:
-				if !lockIsOwned || lockOwner != decidedCommand.ClientID {
-					result = ErrInvalidUnlock
-				} else {
-					delete(localLockMap, decidedCommand.LockName)
-					result = OK
-					logState += fmt.Sprintf(" (%d %+v)", slot, decidedCommand)
-				}
+		result, performed = thisReplica.clientResults[req.Command.ClientID]
+	}
+	if result.MsgID == req.Command.MsgID {
+		res.Err = OK
+		res.Result = result.Result
+	} else {
+		res.Err = ErrStaleRequest
+	}
+	_, config := thisReplica.configAt(thisReplica.slotOut)
+	res.Replicas = config.Replicas
+	return nil
+}
+
+// Handler for read-only queries from clients
+// Answers from the state machine without deciding a slot. To be
+// linearizable, the replica first learns the read index, a slot at least
+// as high as every slot decided before the query arrived, and answers
+// once it applied it. Applying the read index may bring in force a
+// configuration the read index did not ask the acceptors of, which then
+// takes another round.
+func (thisReplica *Replica) Query(req QueryRequest, res *QueryResponse) (err error) {
+	thisReplica.mu.Lock()
+	defer thisReplica.mu.Unlock()
+	queryable, ok := thisReplica.stateMachine.(Queryable)
+	if !ok {
+		res.Err = ErrInvalidCommand
+		return nil
+	}
+	timedOut := false
+	timer := time.AfterFunc(queryTimeoutMillis*time.Millisecond, func() {
+		thisReplica.mu.Lock()
+		timedOut = true
+		thisReplica.somethingPerformed.Broadcast()
+		thisReplica.mu.Unlock()
+	})
+	defer timer.Stop()
+	for {
+		configs := make(map[int]Configuration)
+		for start, config := range thisReplica.configs {
+			configs[start] = config
+		}
+		thisReplica.mu.Unlock()
+		readIndex, ok := thisReplica.learnReadIndex(configs)
+		thisReplica.mu.Lock()
+		if !ok {
+			res.Err = ErrConnectionError
+			return nil
+		}
+		if readIndex > thisReplica.readIndex {
+			thisReplica.readIndex = readIndex
+			thisReplica.fillGaps()
+		}
+		for thisReplica.slotOut <= readIndex && !timedOut {
+			thisReplica.somethingPerformed.Wait()
+		}
+		if timedOut {
+			res.Err = ErrTimeout
+			return nil
+		}
+		if sameConfigs(configs, thisReplica.configs) {
+			break
+		}
+	}
+	log.Printf("Replica %d answering a query at slot %d\n", thisReplica.replicaID, thisReplica.slotOut)
+	res.Err = OK
+	res.Result = queryable.Query(req.Query)
+	return nil
+}
+
+// Asks the acceptors of every configuration for the highest slot they
+// accepted a value in. Returns the highest slot a majority of the
+// acceptors of each configuration answered with, and false if not
+// enough acceptors answered.
+func (thisReplica *Replica) learnReadIndex(configs map[int]Configuration) (readIndex int, ok bool) {
+	acceptors := make(map[string]bool)
+	for _, config := range configs {
+		for _, acceptor := range config.Acceptors {
+			acceptors[acceptor] = true
+		}
+	}
+	readIndexChannel := make(chan interface{}, len(acceptors))
+	ctx, cancel := rpcContext()
+	defer cancel()
+	for acceptor := range acceptors {
+		response := new(ReadIndexResponse)
+		go CallContext(ctx, thisReplica.transport, acceptor, "Acceptor.ExecuteReadIndex", ReadIndexRequest{Address: acceptor}, response, readIndexChannel)
+	}
+	received := make(map[string]bool)
+	for range acceptors {
+		response := <-readIndexChannel
+		if response == false {
+			continue
+		}
+		readIndexResponse := response.(*ReadIndexResponse)
+		received[readIndexResponse.Address] = true
+		if readIndexResponse.Slot > readIndex {
+			readIndex = readIndexResponse.Slot
+		}
+		if majorityOfEach(configs, received) {
+			return readIndex, true
+		}
+	}
+	return 0, false
+}
+
+// Returns true if the acceptors that answered include a majority of the
+// acceptors of every configuration
+func majorityOfEach(configs map[int]Configuration, received map[string]bool) bool {
+	for _, config := range configs {
+		count := 0
+		for _, acceptor := range config.Acceptors {
+			if received[acceptor] {
+				count++
 			}
-			if decidedCommand.Equals(req.Command) {
-				requestDecided = true
-				res.Err = result
-				break
+		}
+		if count < majority(len(config.Acceptors)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if two sets of configurations start at the same slots
+func sameConfigs(configs map[int]Configuration, others map[int]Configuration) bool {
+	if len(configs) != len(others) {
+		return false
+	}
+	for start := range configs {
+		if _, present := others[start]; !present {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler for watch requests from clients
+// Waits until the state machine reported events after the slot the
+// client got events up to, for the names it watches, or until the
+// request times out
+func (thisReplica *Replica) Watch(req WatchRequest, res *WatchResponse) (err error) {
+	thisReplica.mu.Lock()
+	defer thisReplica.mu.Unlock()
+	afterSlot := req.AfterSlot
+	if afterSlot < 0 {
+		afterSlot = thisReplica.slotOut - 1
+	}
+	timedOut := false
+	timer := time.AfterFunc(time.Duration(req.TimeoutMillis)*time.Millisecond, func() {
+		thisReplica.mu.Lock()
+		timedOut = true
+		thisReplica.somethingPerformed.Broadcast()
+		thisReplica.mu.Unlock()
+	})
+	defer timer.Stop()
+	for {
+		if afterSlot < thisReplica.eventsSince {
+			res.Err = ErrCompacted
+			res.Slot = thisReplica.slotOut - 1
+			return nil
+		}
+		for _, event := range thisReplica.events {
+			if event.Slot > afterSlot && under(event.Name, req.Prefix) {
+				res.Events = append(res.Events, event)
 			}
 		}
-		log.Printf(logState)
+		if len(res.Events) > 0 || timedOut || thisReplica.isDead() {
+			break
+		}
+		thisReplica.somethingPerformed.Wait()
+	}
+	res.Err = OK
+	res.Slot = thisReplica.slotOut - 1
+	return nil
+}
+
+// Handler for progress requests from the other replicas
+func (thisReplica *Replica) ExecuteProgress(req ProgressRequest, res *ProgressResponse) (err error) {
+	thisReplica.mu.Lock()
+	defer thisReplica.mu.Unlock()
+	res.Address = req.Address
+	res.SlotOut = thisReplica.slotOut
+	res.Joining = thisReplica.joining
+	return nil
+}
+
+// Periodically proposes a Tick command with the replica's clock, while the
+// state machine has something waiting on the replicated clock. Ticks are
+// deduplicated by their time like client commands by their message id, so
+// the replicated clock only moves forward.
+func (thisReplica *Replica) tick() {
+	clocked, ok := thisReplica.stateMachine.(Clocked)
+	if !ok {
+		return
+	}
+	for !thisReplica.isDead() {
+		time.Sleep(tickIntervalMillis * time.Millisecond)
+		thisReplica.mu.Lock()
+		if thisReplica.joining || !clocked.NeedsTicks() {
+			thisReplica.mu.Unlock()
+			continue
+		}
+		ticking := false
+		for _, request := range thisReplica.requests {
+			ticking = ticking || request.Kind == Tick
+		}
+		for _, proposal := range thisReplica.proposals {
+			ticking = ticking || proposal.Kind == Tick
+		}
+		if !ticking {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			thisReplica.requests = append(thisReplica.requests, Command{
+				Kind:     Tick,
+				MsgID:    int(now),
+				ClientID: tickClientID,
+				Time:     now,
+			})
+			thisReplica.newRequest.Signal()
+		}
 		thisReplica.mu.Unlock()
 	}
+}
+
+// Periodically finds the slots that every replica has applied and tells
+// the leaders, and through them the acceptors, to garbage collect them.
+// Replicas that fell too far behind, or behind the compacted slots, are
+// sent a snapshot.
+func (thisReplica *Replica) compact() {
+	for !thisReplica.isDead() {
+		time.Sleep(compactionIntervalMillis * time.Millisecond)
+		thisReplica.mu.Lock()
+		slotOut := thisReplica.slotOut
+		compactedSlot := thisReplica.compactedSlot
+		joining := thisReplica.joining
+		_, config := thisReplica.configAt(slotOut)
+		thisReplica.mu.Unlock()
+		if joining {
+			continue
+		}
+
+		progressChannel := make(chan interface{}, len(config.Replicas))
+		ctx, cancel := rpcContext()
+		for _, replica := range config.Replicas {
+			response := new(ProgressResponse)
+			go CallContext(ctx, thisReplica.transport, replica, "Replica.ExecuteProgress", ProgressRequest{Address: replica}, response, progressChannel)
+		}
+		progress := make(map[string]int)
+		for range config.Replicas {
+			response := <-progressChannel
+			if response == false {
+				continue
+			}
+			progressResponse := response.(*ProgressResponse)
+			progress[progressResponse.Address] = progressResponse.SlotOut
+			if progressResponse.Joining ||
+				progressResponse.SlotOut < compactedSlot ||
+				progressResponse.SlotOut+thisReplica.snapshotLag < slotOut {
+				thisReplica.sendSnapshot(progressResponse.Address)
+			}
+		}
+		cancel()
+		if len(progress) < len(config.Replicas) {
+			// Can't tell what an unreachable replica still needs
+			continue
+		}
+
+		minimumSlot := slotOut
+		for _, replicaSlotOut := range progress {
+			if replicaSlotOut < minimumSlot {
+				minimumSlot = replicaSlotOut
+			}
+		}
+		thisReplica.mu.Lock()
+		if minimumSlot <= thisReplica.compactedSlot {
+			thisReplica.mu.Unlock()
+			continue
+		}
+		thisReplica.compactedSlot = minimumSlot
+		thisReplica.mu.Unlock()
+		log.Printf("Replica %d compacting slots below %d\n", thisReplica.replicaID, minimumSlot)
+		compactChannel := make(chan interface{}, len(config.Leaders))
+		ctx, cancel = rpcContext()
+		for _, leader := range config.Leaders {
+			response := new(CompactResponse)
+			go CallContext(ctx, thisReplica.transport, leader, "Leader.ExecuteCompact", CompactRequest{Slot: minimumSlot}, response, compactChannel)
+		}
+		for range config.Leaders {
+			<-compactChannel
+		}
+		cancel()
+	}
+}
+
+// Sends the current state of this replica to a replica that is lagging
+// behind, in chunks of snapshotChunkSize bytes
+func (thisReplica *Replica) sendSnapshot(replica string) {
+	thisReplica.mu.Lock()
+	snapshot := replicaSnapshot{
+		SlotOut:       thisReplica.slotOut,
+		State:         thisReplica.stateMachine.Snapshot(),
+		ClientResults: thisReplica.clientResults,
+		Configs:       thisReplica.configs,
+	}
+	data, err := encodeFrame(snapshot)
+	thisReplica.mu.Unlock()
+	if err != nil {
+		log.Printf("Replica %d failed to encode a snapshot, %s\n", thisReplica.replicaID, err)
+		return
+	}
+	log.Printf("Replica %d sending a snapshot at slot %d to %s\n", thisReplica.replicaID, snapshot.SlotOut, replica)
+
+	snapshotChannel := make(chan interface{}, 1)
+	for offset := 0; offset < len(data); offset += thisReplica.snapshotChunkSize {
+		end := offset + thisReplica.snapshotChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		request := InstallSnapshotRequest{
+			ReplicaID: thisReplica.replicaID,
+			SlotOut:   snapshot.SlotOut,
+			Offset:    offset,
+			Data:      data[offset:end],
+			Done:      end == len(data),
+		}
+		response := new(InstallSnapshotResponse)
+		ctx, cancel := rpcContext()
+		go CallContext(ctx, thisReplica.transport, replica, "Replica.InstallSnapshot", request, response, snapshotChannel)
+		reply := <-snapshotChannel
+		cancel()
+		if reply == false {
+			return
+		}
+	}
+}
+
+// Handler for snapshots sent by a healthy replica to this one
+// Chunks are buffered until the last one arrives, then the snapshot
+// replaces the replica's state if it is ahead of it
+func (thisReplica *Replica) InstallSnapshot(req InstallSnapshotRequest, res *InstallSnapshotResponse) (err error) {
+	thisReplica.mu.Lock()
+	defer thisReplica.mu.Unlock()
+	if req.Offset == 0 {
+		thisReplica.incomingSnapshots[req.ReplicaID] = nil
+	}
+	if req.Offset != len(thisReplica.incomingSnapshots[req.ReplicaID]) {
+		delete(thisReplica.incomingSnapshots, req.ReplicaID)
+		return errors.New("Snapshot chunk out of order")
+	}
+	thisReplica.incomingSnapshots[req.ReplicaID] = append(thisReplica.incomingSnapshots[req.ReplicaID], req.Data...)
+	res.SlotOut = thisReplica.slotOut
+	if !req.Done {
+		return nil
+	}
+
+	data := thisReplica.incomingSnapshots[req.ReplicaID]
+	delete(thisReplica.incomingSnapshots, req.ReplicaID)
+	if req.SlotOut <= thisReplica.slotOut && !thisReplica.joining {
+		// We caught up in the meantime
+		return nil
+	}
+	var snapshot replicaSnapshot
+	if err = decodeFrame(data, &snapshot); err != nil {
+		log.Printf("Replica %d dropped a snapshot from replica %d, %s\n", thisReplica.replicaID, req.ReplicaID, err)
+		return err
+	}
+	if err = thisReplica.installSnapshot(snapshot); err != nil {
+		return err
+	}
+	res.SlotOut = thisReplica.slotOut
+	return nil
+}
+
+// Replaces the replica's state with a snapshot that is ahead of it
+// Must be called with the lock held
+func (thisReplica *Replica) installSnapshot(snapshot replicaSnapshot) (err error) {
+	log.Printf("Replica %d installing a snapshot at slot %d\n", thisReplica.replicaID, snapshot.SlotOut)
+	if err = thisReplica.stateMachine.Restore(snapshot.State); err != nil {
+		log.Printf("Replica %d failed to restore the state machine, %s\n", thisReplica.replicaID, err)
+		return err
+	}
+	thisReplica.restoreTables(snapshot)
+	thisReplica.joining = false
+	// The events of the skipped slots are lost
+	thisReplica.events = nil
+	thisReplica.eventsSince = snapshot.SlotOut - 1
+	for slot := range thisReplica.decisions {
+		if slot < snapshot.SlotOut {
+			delete(thisReplica.decisions, slot)
+		}
+	}
+	// Proposals in the skipped slots were decided one way or another,
+	// propose again the ones the snapshot has not performed
+	for slot, command := range thisReplica.proposals {
+		if slot >= snapshot.SlotOut {
+			continue
+		}
+		delete(thisReplica.proposals, slot)
+		if command.fromClient() && !thisReplica.performed(command) {
+			thisReplica.requests = append(thisReplica.requests, command)
+			thisReplica.newRequest.Signal()
+		}
+	}
+	thisReplica.slotOut = snapshot.SlotOut
+	if thisReplica.slotIn < thisReplica.slotOut {
+		thisReplica.slotIn = thisReplica.slotOut
+	}
+	if thisReplica.wal != nil {
+		thisReplica.takeSnapshot()
+	}
+	thisReplica.somethingPerformed.Broadcast()
+	thisReplica.newRequest.Signal()
+
+	// Learn what was decided after the snapshot
+	go thisReplica.catchUp()
 	return nil
 }
 
+// Takes the results table and the configurations of a snapshot. A table
+// the snapshot was written without (gob skips nil maps) is decoded as
+// nil, so it is allocated here.
+// Must be called with the lock held
+func (thisReplica *Replica) restoreTables(snapshot replicaSnapshot) {
+	thisReplica.clientResults = snapshot.ClientResults
+	if thisReplica.clientResults == nil {
+		thisReplica.clientResults = make(map[int]clientResult)
+	}
+	thisReplica.configs = snapshot.Configs
+	if thisReplica.configs == nil {
+		thisReplica.configs = make(map[int]Configuration)
+	}
+}
+
+// Writes a snapshot of the state machine at slotOut and empties the log,
+// which only held the decisions that are now part of the snapshot
+// Must be called with the lock held
+func (thisReplica *Replica) takeSnapshot() {
+	snapshot := replicaSnapshot{
+		SlotOut:       thisReplica.slotOut,
+		State:         thisReplica.stateMachine.Snapshot(),
+		ClientResults: thisReplica.clientResults,
+		Configs:       thisReplica.configs,
+	}
+	if err := writeSnapshot(thisReplica.snapshotPath, snapshot); err != nil {
+		log.Printf("Replica %d failed to write a snapshot at slot %d, %s\n", thisReplica.replicaID, thisReplica.slotOut, err)
+		return
+	}
+	if err := thisReplica.wal.rewrite(nil); err != nil {
+		log.Printf("Replica %d failed to truncate its log, %s\n", thisReplica.replicaID, err)
+		return
+	}
+	thisReplica.snapshotSlot = thisReplica.slotOut
+	log.Printf("Replica %d took a snapshot at slot %d\n", thisReplica.replicaID, thisReplica.slotOut)
+}
+
+// Asks the leaders for the slots that were decided while this replica
+// was down, and hands them to perform()
+func (thisReplica *Replica) catchUp() {
+	thisReplica.mu.Lock()
+	request := CatchUpRequest{Slot: thisReplica.slotOut}
+	_, config := thisReplica.configAt(thisReplica.slotOut)
+	thisReplica.mu.Unlock()
+
+	catchUpChannel := make(chan interface{}, len(config.Leaders))
+	ctx, cancel := rpcContext()
+	defer cancel()
+	for _, leader := range config.Leaders {
+		response := new(CatchUpResponse)
+		go CallWithRetries(ctx, thisReplica.transport, leader, "Leader.ExecuteCatchUp", request, response, catchUpChannel)
+	}
+	known := make(map[int]bool)
+	for range config.Leaders {
+		response := <-catchUpChannel
+		if response == false {
+			continue
+		}
+		for slot, command := range response.(*CatchUpResponse).Decisions {
+			known[slot] = true
+			thisReplica.replicaResponses <- &ReplicaResponse{Command: command, Slot: slot}
+		}
+	}
+	log.Printf("Replica %d caught up on %d slots from slot %d\n", thisReplica.replicaID, len(known), request.Slot)
+}
+
+// Slots inside the window that no leader told us about, but that lie
+// before a slot that is known to be decided, are filled by proposing
+// no-ops: the leaders either respond with what was already chosen for
+// them or decide the no-op.
+// Must be called with the lock held
+func (thisReplica *Replica) fillGaps() {
+	highestSlot := thisReplica.slotOut - 1
+	for slot := range thisReplica.decisions {
+		if slot > highestSlot {
+			highestSlot = slot
+		}
+	}
+	if thisReplica.readIndex >= highestSlot {
+		highestSlot = thisReplica.readIndex + 1
+	}
+	windowEnd := thisReplica.windowEnd()
+	for slot := thisReplica.slotOut; slot < highestSlot && slot < windowEnd; slot++ {
+		_, decided := thisReplica.decisions[slot]
+		_, proposed := thisReplica.proposals[slot]
+		if !decided && !proposed {
+			thisReplica.sendProposal(slot, Command{Kind: Noop, MsgID: slot, ClientID: noopClientID})
+		}
+	}
+}
+
+// Persists a record if the replica has a log
+// Must be called with the lock held
+func (thisReplica *Replica) persist(record replicaRecord) (err error) {
+	if thisReplica.wal == nil {
+		return nil
+	}
+	return thisReplica.wal.append(record)
+}
+
+// Loads the replica's snapshot in DataDir and replays its log on top of
+// it to rebuild the state machine and the slot numbers from before a restart
+func (thisReplica *Replica) recover(DataDir string) (err error) {
+	if err = os.MkdirAll(DataDir, 0755); err != nil {
+		return err
+	}
+	thisReplica.snapshotPath = filepath.Join(DataDir, replicaSnapshotName)
+	var snapshot replicaSnapshot
+	found, err := readSnapshot(thisReplica.snapshotPath, &snapshot)
+	if err != nil {
+		return err
+	} else if found {
+		if err = thisReplica.stateMachine.Restore(snapshot.State); err != nil {
+			return err
+		}
+		thisReplica.restoreTables(snapshot)
+		thisReplica.slotOut = snapshot.SlotOut
+		thisReplica.slotIn = snapshot.SlotOut
+		thisReplica.snapshotSlot = snapshot.SlotOut
+		thisReplica.eventsSince = snapshot.SlotOut - 1
+	}
+
+	thisReplica.wal, err = openWriteAheadLog(filepath.Join(DataDir, replicaLogName))
+	if err != nil {
+		return err
+	}
+	return thisReplica.wal.replay(func(data []byte) error {
+		var record replicaRecord
+		if err := decodeRecord(data, &record); err != nil {
+			return err
+		}
+		if record.Slot < thisReplica.slotOut {
+			// Already part of the snapshot
+			return nil
+		}
+		thisReplica.execute(record.Slot, record.Command)
+		thisReplica.slotOut = record.Slot + 1
+		thisReplica.slotIn = thisReplica.slotOut
+		thisReplica.retireConfigs()
+		return nil
+	})
+}
+
 func (thisReplica *Replica) kill() {
 	log.Printf("Killing replica %d\n", thisReplica.replicaID)
 	atomic.StoreInt32(&thisReplica.dead, 1)
-	if thisReplica.listener != nil {
-		thisReplica.listener.Close()
+	if thisReplica.Address != "" {
+		thisReplica.transport.Close(thisReplica.Address)
+	}
+	thisReplica.mu.Lock()
+	for _, server := range thisReplica.grpcServers {
+		server.Close()
+	}
+	thisReplica.mu.Unlock()
+	if thisReplica.wal != nil {
+		thisReplica.wal.close()
 	}
 }
 
@@ -195,49 +1089,130 @@ func (thisReplica *Replica) isDead() bool {
 
 //StartReplica starts an acceptor instance and returns an Replica struct.
 //The struct can be used to kill this instance.
-func StartReplica(ReplicaID int, LeaderAddresses []string, Address string) (replica *Replica) {
-	server := rpc.NewServer()
-	listener, err := net.Listen("tcp", Address)
+//Config is the initial configuration of the cluster, which must list
+//this replica. It is in force until a Reconfigure command replaces it.
+//The operations clients send are applied to StateMachine, which must
+//start out in the same state on every replica.
+//Every decision the replica applies is logged to DataDir and periodically
+//folded into a snapshot. A replica restarted on the same DataDir reloads
+//its state, including the configurations decided since, and then catches
+//up on the slots it missed from the leaders. An empty DataDir keeps the
+//state in memory only.
+func StartReplica(
+	ReplicaID int,
+	Config Configuration,
+	StateMachine StateMachine,
+	Address string,
+	DataDir string,
+	Transport Transport,
+) (replica *Replica) {
+	return startReplica(ReplicaID, Config, StateMachine, Address, DataDir, false, Transport)
+}
+
+// JoinReplica starts a replica that is added to a running cluster.
+// Config is the configuration that adds it. The replica does not propose
+// anything until one of the other replicas of Config has sent it a snapshot.
+func JoinReplica(
+	ReplicaID int,
+	Config Configuration,
+	StateMachine StateMachine,
+	Address string,
+	DataDir string,
+	Transport Transport,
+) (replica *Replica) {
+	return startReplica(ReplicaID, Config, StateMachine, Address, DataDir, true, Transport)
+}
+
+func startReplica(
+	ReplicaID int,
+	Config Configuration,
+	StateMachine StateMachine,
+	Address string,
+	DataDir string,
+	Joining bool,
+	Transport Transport,
+) (replica *Replica) {
+	replica = newReplica(ReplicaID, Config, StateMachine, DataDir, Joining, Transport)
+	replica.serve(Address)
+	replica.run()
+	return replica
+}
+
+// Builds a replica, recovering its state from DataDir, without serving or
+// running it yet
+func newReplica(
+	ReplicaID int,
+	Config Configuration,
+	StateMachine StateMachine,
+	DataDir string,
+	Joining bool,
+	Transport Transport,
+) (replica *Replica) {
+	replica = &Replica{
+		mu:                sync.Mutex{},
+		replicaResponses:  make(chan interface{}, ReplicaResponsesChannelSize),
+		replicaID:         ReplicaID,
+		stateMachine:      StateMachine,
+		clientResults:     make(map[int]clientResult),
+		slotIn:            1,
+		slotOut:           1,
+		requests:          make([]Command, 0),
+		proposals:         make(map[int]Command),
+		decisions:         make(map[int]Command),
+		configs:           map[int]Configuration{1: Config},
+		joining:           Joining,
+		snapshotSlot:      1,
+		snapshotInterval:  replicaSnapshotInterval,
+		snapshotLag:       replicaSnapshotLag,
+		snapshotChunkSize: replicaSnapshotChunkSize,
+		incomingSnapshots: make(map[int][]byte),
+		dead:              0,
+	}
+	replica.newRequest = sync.Cond{L: &replica.mu}
+	replica.somethingPerformed = sync.Cond{L: &replica.mu}
+	if DataDir != "" {
+		if err := replica.recover(DataDir); err != nil {
+			log.Fatalf(
+				"Replica %d failed to recover from %s, %s\n",
+				ReplicaID,
+				DataDir,
+				err,
+			)
+			return nil
+		}
+		log.Printf("Replica %d recovered up to slot %d\n", ReplicaID, replica.slotOut)
+		if replica.slotOut > 1 {
+			// Already joined before the restart
+			replica.joining = false
+		}
+	}
+	replica.transport = Transport
+	return replica
+}
+
+// Serves the RPC handlers of the replica at Address, or at an address its
+// transport picks if Address is empty
+func (thisReplica *Replica) serve(Address string) {
+	address, err := thisReplica.transport.Serve(Address, thisReplica)
 	if err != nil {
 		log.Fatalf(
 			"Replica %d failed to set up listening address %s, %s\n",
-			ReplicaID,
+			thisReplica.replicaID,
 			Address,
 			err,
 		)
-		return nil
+		return
 	}
-	replica = &Replica{
-		mu:               sync.Mutex{},
-		replicaResponses: make(chan interface{}, ReplicaResponsesChannelSize),
-		replicaID:        ReplicaID,
-		lockMap:          make(map[string]int),
-		slotIn:           1,
-		slotOut:          1,
-		requests:         make([]Command, 0),
-		proposals:        make(map[int]Command),
-		decisions:        make(map[int]Command),
-		leaders:          LeaderAddresses,
-		listener:         listener,
-		dead:             0,
-		Address:          listener.Addr().String(),
+	thisReplica.Address = address
+}
+
+// Starts the goroutines of the replica
+func (thisReplica *Replica) run() {
+	go thisReplica.propose()
+	go thisReplica.perform()
+	if !thisReplica.joining {
+		go thisReplica.catchUp()
 	}
-	replica.newRequest = sync.Cond{L: &replica.mu}
-	replica.somethingPerformed = sync.Cond{L: &replica.mu}
-	server.Register(replica)
-
-	go replica.propose()
-	go replica.perform()
-
-	go func() {
-		for !replica.isDead() {
-			connection, err := replica.listener.Accept()
-			if err == nil {
-				go server.ServeConn(connection)
-			} else if err != nil && !replica.isDead() {
-				log.Fatalf("Replica %d failed to accept connection, %s\n", ReplicaID, err)
-			}
-		}
-	}()
-	return replica
+	go thisReplica.compact()
+	go thisReplica.tick()
 }
@@ -0,0 +1,97 @@
+package lspaxos
+
+import (
+	"strings"
+)
+
+// A deterministic state machine replicated by the replicas. Every replica
+// applies the same commands in the same order, so they all go through the
+// same states and return the same results.
+// The replica calls the methods one at a time, so implementations don't
+// need to synchronize.
+type StateMachine interface {
+	// Applies an operation sent by a client and returns its result
+	Apply(command []byte) []byte
+
+	// Returns the encoded state, e.g. for a replica that lags behind
+	Snapshot() []byte
+
+	// Replaces the state with one returned by Snapshot
+	Restore(snapshot []byte) error
+}
+
+// Implemented by state machines whose state depends on time, e.g. to
+// expire leases. Time is replicated through the log: while the state
+// machine needs it, replicas regularly propose Tick commands carrying
+// their clock, so that every replica sees the clock advance at the same
+// slots.
+type Clocked interface {
+	StateMachine
+
+	// Advances the clock to now, in milliseconds since the epoch. The
+	// clock never goes back in time.
+	Tick(now int64)
+
+	// Tells if the state machine has anything waiting on the clock.
+	// Replicas only propose ticks while it does.
+	NeedsTicks() bool
+}
+
+// Implemented by state machines with operations that complete after the
+// slot they are applied in, such as a lock that is granted once its
+// holder releases it. Apply returns nil for such an operation, and the
+// client waits until the result shows up in Completed.
+type Deferred interface {
+	StateMachine
+
+	// Returns the results of the operations that completed since the
+	// last call, by the client that sent them. Clients have one operation
+	// outstanding at a time, so there is at most one result per client.
+	Completed() map[int][]byte
+}
+
+// Implemented by state machines that answer read-only queries, which
+// replicas answer without deciding a slot
+type Queryable interface {
+	StateMachine
+
+	// Answers a query sent by a client. Must not change the state.
+	Query(query []byte) []byte
+}
+
+// Implemented by state machines that report the changes of their named
+// objects, such as locks being acquired and released, to the clients
+// watching them
+type Watched interface {
+	StateMachine
+
+	// Returns the events of the commands applied since the last call,
+	// in the order they happened
+	Events() []Event
+}
+
+// A change of a named object of the state machine
+type Event struct {
+	// Slot the change happened in, set by the replica
+	Slot int
+
+	// Name of the object, a path like /svc/db/shard-3
+	Name string
+
+	Kind EventKind
+
+	// Client the change is about, e.g. the one that acquired a lock
+	ClientID int
+}
+
+// Returns true if a name is below another one in the hierarchy of names,
+// whose levels are separated by /
+func below(Name string, Ancestor string) bool {
+	return Name != Ancestor && strings.HasPrefix(Name, strings.TrimSuffix(Ancestor, "/")+"/")
+}
+
+// Returns true if a name is the prefix or below it. The empty prefix
+// covers every name.
+func under(Name string, Prefix string) bool {
+	return Prefix == "" || Name == Prefix || below(Name, Prefix)
+}
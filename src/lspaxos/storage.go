@@ -0,0 +1,237 @@
+package lspaxos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Length and checksum that precede every record in the log
+	recordHeaderSize = 8
+)
+
+// An append-only log of gob encoded records kept on disk.
+// Every append is fsync'd before returning, so a record that has been
+// appended survives a crash of the process or the host.
+// Each record is framed with its length and a CRC32 checksum so that a
+// torn write at the tail of the log is detected and dropped on replay.
+type writeAheadLog struct {
+	// Mutex to serialize appends
+	mu sync.Mutex
+
+	// Path of the log file
+	path string
+
+	// Open log file, positioned at the end
+	file *os.File
+}
+
+// Opens (or creates) the log at the given path
+func openWriteAheadLog(path string) (wal *writeAheadLog, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{path: path, file: file}, nil
+}
+
+// Encodes a record without any framing
+func encodeRecord(record interface{}) (data []byte, err error) {
+	var payload bytes.Buffer
+	if err = gob.NewEncoder(&payload).Encode(record); err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// Encodes a record with its length and checksum
+func encodeFrame(record interface{}) (frame []byte, err error) {
+	payload, err := encodeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	frame = make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[recordHeaderSize:], payload)
+	return frame, nil
+}
+
+// Encodes a record and durably appends it to the log
+func (wal *writeAheadLog) append(record interface{}) (err error) {
+	frame, err := encodeFrame(record)
+	if err != nil {
+		return err
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if _, err = wal.file.Write(frame); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// Calls handler with every record in the log, in the order they were
+// appended. A partially written record at the end of the log is
+// truncated away so that new records are appended after the last good
+// one. A corrupt record anywhere else is an error, since the records
+// after it were acknowledged.
+func (wal *writeAheadLog) replay(handler func(data []byte) error) (err error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	info, err := wal.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = wal.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		// The length of a torn record can run past the end of the file
+		remaining := info.Size() - offset - recordHeaderSize
+		if remaining < 0 {
+			break
+		}
+		if _, err = io.ReadFull(wal.file, header); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > remaining {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(wal.file, payload); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			if length < remaining {
+				return errors.New("Corrupt record at offset " + strconv.FormatInt(offset, 10) + " in " + wal.path)
+			}
+			break
+		}
+		if err = handler(payload); err != nil {
+			return err
+		}
+		offset += int64(recordHeaderSize + len(payload))
+	}
+	if err = wal.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = wal.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Atomically replaces the contents of the log with the given records.
+// This is how the log is compacted: the caller passes the records needed
+// to rebuild its current state, and everything else is dropped.
+func (wal *writeAheadLog) rewrite(records []interface{}) (err error) {
+	var contents bytes.Buffer
+	for _, record := range records {
+		frame, err := encodeFrame(record)
+		if err != nil {
+			return err
+		}
+		contents.Write(frame)
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if err = writeFileAtomically(wal.path, contents.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(wal.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file.Close()
+	wal.file = file
+	return nil
+}
+
+func (wal *writeAheadLog) close() (err error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.file.Close()
+}
+
+// Decodes a record read back from the log
+func decodeRecord(data []byte, record interface{}) (err error) {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(record)
+}
+
+// Writes data to a temporary file next to path, fsyncs it and renames it
+// over path, so that a crash leaves either the old or the new contents
+func writeFileAtomically(path string, data []byte) (err error) {
+	temporaryPath := path + ".tmp"
+	file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(temporaryPath, path); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	directory, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
+
+// Durably writes a snapshot to path, replacing the previous one
+func writeSnapshot(path string, snapshot interface{}) (err error) {
+	frame, err := encodeFrame(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, frame)
+}
+
+// Reads the snapshot at path. Returns false if there is none.
+func readSnapshot(path string, snapshot interface{}) (found bool, err error) {
+	frame, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = decodeFrame(frame, snapshot); err != nil {
+		return false, errors.New(err.Error() + " in snapshot " + path)
+	}
+	return true, nil
+}
+
+// Checks the length and checksum of a frame made by encodeFrame, and
+// decodes its record
+func decodeFrame(frame []byte, record interface{}) (err error) {
+	if len(frame) < recordHeaderSize {
+		return errors.New("Truncated frame")
+	}
+	payload := frame[recordHeaderSize:]
+	if uint32(len(payload)) != binary.BigEndian.Uint32(frame[0:4]) ||
+		crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:8]) {
+		return errors.New("Corrupt frame")
+	}
+	return decodeRecord(payload, record)
+}
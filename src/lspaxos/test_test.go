@@ -1,6 +1,19 @@
 package lspaxos
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -15,11 +28,42 @@ const (
 	timeoutMillisMultDec int    = 2
 )
 
+// Transport of the roles the tests start
+var tcpTransport = NewTCPTransport()
+
 func failOnError(t *testing.T, err Err, format string, args ...interface{}) {
 	if err != OK {
-		t.Errorf(string(err))
-		t.Errorf(format, args)
+		t.Error(string(err))
+		t.Errorf(format, args...)
+	}
+}
+
+// Returns a copy of the locks held on a replica of the lock server
+func locksOf(replica *Replica) map[string]int {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	locks := make(map[string]int)
+	for lockName, clientID := range replica.stateMachine.(*LockServer).locks {
+		locks[lockName] = clientID
+	}
+	return locks
+}
+
+// Returns the next slot a replica applies
+func slotOutOf(replica *Replica) int {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	return replica.slotOut
+}
+
+// Picks a free local address for a server that is started later
+func reserveAddress() string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		log.Fatalf("Failed to reserve an address, %s\n", err)
 	}
+	defer listener.Close()
+	return listener.Addr().String()
 }
 
 func cleanup(acceptors []*Acceptor, leaders []*Leader, replicas []*Replica) {
@@ -42,7 +86,7 @@ func cleanup(acceptors []*Acceptor, leaders []*Leader, replicas []*Replica) {
 }
 
 func TestKillAcceptor(t *testing.T) {
-	_, acceptors := StartAcceptors(1)
+	_, acceptors := StartAcceptors(1, tcpTransport)
 	if acceptors[0].isDead() {
 		t.Errorf("Acceptor is dead, expected to be alive\n")
 	}
@@ -53,9 +97,201 @@ func TestKillAcceptor(t *testing.T) {
 
 }
 
+func TestAcceptorRecovery(t *testing.T) {
+	dataDir := t.TempDir()
+	acceptor := StartAcceptor(0, "", dataDir, tcpTransport)
+	promised := Ballot{Number: 3, Leader: 1}
+	command := newLockCommand(0, 1, "A", Lock)
+	acceptor.ExecutePropose(ScoutRequest{Ballot: promised}, new(ScoutResponse))
+	acceptor.ExecuteAccept(CommanderRequest{Command: command, Slot: 1, Ballot: promised}, new(CommanderResponse))
+	acceptor.ExecutePropose(ScoutRequest{Ballot: Ballot{Number: 4, Leader: 0}}, new(ScoutResponse))
+	acceptor.kill()
+
+	acceptor = StartAcceptor(0, acceptor.Address, dataDir, tcpTransport)
+	response := new(ScoutResponse)
+	acceptor.ExecutePropose(ScoutRequest{Ballot: promised}, response)
+	if response.Ballot.Compare(Ballot{Number: 4, Leader: 0}) != 0 {
+		t.Errorf("Acceptor recovered ballot %+v, expected 4.0\n", response.Ballot)
+	}
+	if accepted, present := response.AcceptedValues[1]; !present || !accepted.Equals(command) {
+		t.Errorf("Acceptor recovered accepted values %+v\n", response.AcceptedValues)
+	}
+	acceptor.kill()
+}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	replay := func() ([]int, error) {
+		wal, err := openWriteAheadLog(path)
+		if err != nil {
+			t.Fatalf("Failed to open the log, %s\n", err)
+		}
+		defer wal.file.Close()
+		records := make([]int, 0)
+		err = wal.replay(func(data []byte) error {
+			var record int
+			if err := decodeRecord(data, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+		return records, err
+	}
+	wal, err := openWriteAheadLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open the log, %s\n", err)
+	}
+	for record := 1; record <= 3; record++ {
+		if err := wal.append(record); err != nil {
+			t.Fatalf("Failed to append, %s\n", err)
+		}
+	}
+	wal.file.Close()
+	contents, _ := os.ReadFile(path)
+	recordSize := len(contents) / 3
+
+	// A torn record at the end, whose length runs past the end of the
+	// file, is dropped
+	torn := append(append([]byte{}, contents...), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1)
+	os.WriteFile(path, torn, 0644)
+	if records, err := replay(); err != nil || !reflect.DeepEqual(records, []int{1, 2, 3}) {
+		t.Errorf("Replayed %v, %v after a torn record\n", records, err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(contents)) {
+		t.Errorf("Log was truncated to %d bytes, expected %d\n", info.Size(), len(contents))
+	}
+
+	// So is a last record that does not match its checksum
+	corrupt := append([]byte{}, contents...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	os.WriteFile(path, corrupt, 0644)
+	if records, err := replay(); err != nil || !reflect.DeepEqual(records, []int{1, 2}) {
+		t.Errorf("Replayed %v, %v after a corrupt last record\n", records, err)
+	}
+
+	// But a corrupt record before others is an error
+	corrupt = append([]byte{}, contents...)
+	corrupt[2*recordSize-1] ^= 0xff
+	os.WriteFile(path, corrupt, 0644)
+	if _, err := replay(); err == nil {
+		t.Errorf("Replayed a log with a corrupt record in the middle\n")
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(contents)) {
+		t.Errorf("Log was truncated to %d bytes after an error\n", info.Size())
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	acceptor := StartAcceptor(0, "", "", tcpTransport)
+	done := make(chan interface{}, 1)
+	request := ReadIndexRequest{Address: acceptor.Address}
+	Call(tcpTransport, acceptor.Address, "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	if <-done == false {
+		t.Fatalf("Call to acceptor failed\n")
+	}
+	tcpTransport.pool.mu.Lock()
+	client := tcpTransport.pool.clients[acceptor.Address]
+	tcpTransport.pool.mu.Unlock()
+	Call(tcpTransport, acceptor.Address, "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	<-done
+	tcpTransport.pool.mu.Lock()
+	if tcpTransport.pool.clients[acceptor.Address] != client {
+		t.Errorf("Second call did not reuse the connection\n")
+	}
+	tcpTransport.pool.mu.Unlock()
+
+	// A killed server cuts off the connection, and a restarted one is
+	// reached over a new connection
+	acceptor.kill()
+	Call(tcpTransport, acceptor.Address, "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	if <-done != false {
+		t.Errorf("Call to killed acceptor succeeded\n")
+	}
+	acceptor = StartAcceptor(0, acceptor.Address, "", tcpTransport)
+	Call(tcpTransport, acceptor.Address, "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	if <-done == false {
+		t.Errorf("Call to restarted acceptor failed\n")
+	}
+	acceptor.kill()
+}
+
+func TestCallContext(t *testing.T) {
+	// A server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s\n", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	hung := listener.Addr().String()
+
+	done := make(chan interface{}, 1)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	CallContext(ctx, tcpTransport, hung, "Acceptor.ExecuteReadIndex", ReadIndexRequest{}, new(ReadIndexResponse), done)
+	cancel()
+	if <-done != false || time.Since(start) > time.Second {
+		t.Errorf("Call to hung server did not fail at its deadline\n")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go CallContext(ctx, tcpTransport, hung, "Acceptor.ExecuteReadIndex", ReadIndexRequest{}, new(ReadIndexResponse), done)
+	cancel()
+	if <-done != false {
+		t.Errorf("Canceled call to hung server succeeded\n")
+	}
+
+	// A leader whose acceptor hangs keeps answering
+	leader := StartLeader(0, []string{hung}, "", "", tcpTransport)
+	time.Sleep(2 * rpcTimeoutMillis * time.Millisecond)
+	heartbeat := make(chan interface{}, 1)
+	go Call(tcpTransport, leader.Address, "Leader.ExecuteHeartbeat", HeartbeatRequest{}, new(HeartbeatResponse), heartbeat)
+	select {
+	case response := <-heartbeat:
+		if response == false || response.(*HeartbeatResponse).Active {
+			t.Errorf("Leader answered %+v\n", response)
+		}
+	case <-time.After(2 * rpcTimeoutMillis * time.Millisecond):
+		t.Errorf("Leader is stuck on its hung acceptor\n")
+	}
+	leader.kill()
+}
+
+func TestCallWithRetries(t *testing.T) {
+	// The acceptor only comes up after the first attempts failed
+	address := reserveAddress()
+	started := make(chan *Acceptor, 1)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		started <- StartAcceptor(0, address, "", tcpTransport)
+	}()
+	done := make(chan interface{}, 1)
+	CallWithRetries(context.Background(), tcpTransport, address, "Acceptor.ExecuteReadIndex", ReadIndexRequest{Address: address}, new(ReadIndexResponse), done)
+	if response := <-done; response == false || response.(*ReadIndexResponse).Address != address {
+		t.Errorf("Retransmitted call got %+v\n", response)
+	}
+	acceptor := <-started
+	acceptor.kill()
+
+	// Retransmissions stop once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), retransmitInitialMillis*time.Millisecond)
+	start := time.Now()
+	CallWithRetries(ctx, tcpTransport, address, "Acceptor.ExecuteReadIndex", ReadIndexRequest{Address: address}, new(ReadIndexResponse), done)
+	cancel()
+	if <-done != false || time.Since(start) > retransmitMaxMillis*time.Millisecond {
+		t.Errorf("Call to killed acceptor was retransmitted past its deadline\n")
+	}
+}
+
 func TestKillLeader(t *testing.T) {
-	acceptorAddresses, acceptors := StartAcceptors(1)
-	_, leaders := StartLeaders(1, acceptorAddresses)
+	acceptorAddresses, acceptors := StartAcceptors(1, tcpTransport)
+	_, leaders := StartLeaders(1, acceptorAddresses, tcpTransport)
 	if leaders[0].isDead() {
 		t.Errorf("Leader is dead, expected to be alive\n")
 	}
@@ -73,9 +309,9 @@ func TestKillLeader(t *testing.T) {
 }
 
 func TestKillReplicas(t *testing.T) {
-	acceptorAddresses, acceptors := StartAcceptors(1)
-	leaderAddresses, leaders := StartLeaders(1, acceptorAddresses)
-	_, replicas := StartReplicas(1, leaderAddresses)
+	acceptorAddresses, acceptors := StartAcceptors(1, tcpTransport)
+	leaderAddresses, leaders := StartLeaders(1, acceptorAddresses, tcpTransport)
+	_, replicas := StartReplicas(1, acceptorAddresses, leaderAddresses, tcpTransport)
 	if replicas[0].isDead() {
 		t.Errorf("Replica is dead, expected to be alive\n")
 	}
@@ -104,15 +340,15 @@ func Test1c1r1l3a(t *testing.T) {
 	numLeaders := 1
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	err = client0.TryLock(lockB)
@@ -129,15 +365,15 @@ func Test1c1r3l3a(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	err = client0.TryLock(lockB)
@@ -154,15 +390,15 @@ func Test1c3r1l3a(t *testing.T) {
 	numLeaders := 1
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	err = client0.TryLock(lockB)
@@ -179,15 +415,15 @@ func Test1c3r3l3a(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	err = client0.TryLock(lockB)
@@ -204,15 +440,15 @@ func Test1c3r3l3aFailingReplicas(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	replicas[0].kill()
@@ -231,15 +467,15 @@ func Test1c3r3l3aFailingLeaders(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	leaders[1].kill()
@@ -258,15 +494,15 @@ func Test1c3r3l3aFailingAcceptors(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	err = client0.TryLock(lockB)
@@ -284,15 +520,15 @@ func Test1c3r3l3aFailingAll(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
 	leaders[1].kill()
@@ -314,15 +550,15 @@ func Test1c1r1l3aInvalidLockRequest(t *testing.T) {
 	numLeaders := 1
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
@@ -341,16 +577,16 @@ func Test2c1r1l3aIndependentLocks(t *testing.T) {
 	numLeaders := 1
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
 	lockB := "B"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
-	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 
 	err := client0.TryLock(lockA)
 	failOnError(t, err, "")
@@ -368,15 +604,15 @@ func Test2c1r1l3aContendingLocks(t *testing.T) {
 	numLeaders := 1
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
-	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 
 	client0Channel := make(chan Err, 100)
 	client1Channel := make(chan Err, 100)
@@ -415,15 +651,15 @@ func Test2c1r1l3aContendingLocksFailingAll(t *testing.T) {
 	numLeaders := 3
 	numAcceptors := 3
 
-	acceptorAddresses, acceptors := StartAcceptors(numAcceptors)
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, replicas := StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
 	time.Sleep(500 * time.Millisecond)
 
 	lockA := "A"
-	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
-	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
 
 	client0Channel := make(chan Err, 100)
 	client1Channel := make(chan Err, 100)
@@ -459,3 +695,1625 @@ func Test2c1r1l3aContendingLocksFailingAll(t *testing.T) {
 	client1.ChanneledUnlock(lockA, client1Channel)
 	cleanup(acceptors, leaders, replicas)
 }
+
+func Test1c1r1l3aRestartingAcceptors(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	dataDirs := make([]string, numAcceptors)
+	acceptorAddresses := make([]string, numAcceptors)
+	acceptors := make([]*Acceptor, numAcceptors)
+	for i := 0; i < numAcceptors; i++ {
+		dataDirs[i] = t.TempDir()
+		acceptors[i] = StartAcceptor(i, "", dataDirs[i], tcpTransport)
+		acceptorAddresses[i] = acceptors[i].Address
+	}
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	lockB := "B"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	err := client0.TryLock(lockA)
+	failOnError(t, err, "")
+	acceptors[1].kill()
+	acceptors[2].kill()
+	acceptors[1] = StartAcceptor(1, acceptorAddresses[1], dataDirs[1], tcpTransport)
+	err = client0.TryLock(lockB)
+	failOnError(t, err, "")
+	err = client0.Unlock(lockA)
+	failOnError(t, err, "")
+	err = client0.Unlock(lockB)
+	failOnError(t, err, "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c2r1l3aRestartingReplica(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	dataDirs := make([]string, numReplicas)
+	replicaAddresses := make([]string, numReplicas)
+	replicas := make([]*Replica, numReplicas)
+	for i := 0; i < numReplicas; i++ {
+		dataDirs[i] = t.TempDir()
+		replicaAddresses[i] = reserveAddress()
+	}
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	for i := 0; i < numReplicas; i++ {
+		replicas[i] = StartReplica(i, config, NewLockServer(), replicaAddresses[i], dataDirs[i], tcpTransport)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	lockB := "B"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	err := client0.TryLock(lockA)
+	failOnError(t, err, "")
+	replicas[1].kill()
+	err = client0.TryLock(lockB)
+	failOnError(t, err, "")
+
+	// Replica 1 reloads lock A from disk and learns lock B from the leader
+	replicas[1] = StartReplica(1, config, NewLockServer(), replicaAddresses[1], dataDirs[1], tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	locks := locksOf(replicas[1])
+	ownerA, heldA := locks[lockA]
+	ownerB, heldB := locks[lockB]
+	if !heldA || ownerA != 0 || !heldB || ownerB != 0 {
+		t.Errorf("Restarted replica did not recover the lock map\n")
+	}
+
+	replicas[0].kill()
+	err = client0.Unlock(lockA)
+	failOnError(t, err, "")
+	err = client0.Unlock(lockB)
+	failOnError(t, err, "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aRestartingReplicaNilResults(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses := []string{reserveAddress()}
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+
+	// A snapshot written without a results table is read back with a nil
+	// one
+	dataDir := t.TempDir()
+	snapshot := replicaSnapshot{
+		SlotOut: 1,
+		State:   NewLockServer().Snapshot(),
+		Configs: map[int]Configuration{1: config},
+	}
+	if err := writeSnapshot(filepath.Join(dataDir, replicaSnapshotName), snapshot); err != nil {
+		t.Fatalf("Failed to write a snapshot, %s\n", err)
+	}
+	replicas := make([]*Replica, numReplicas)
+	replicas[0] = StartReplica(0, config, NewLockServer(), replicaAddresses[0], dataDir, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	err := client0.TryLock("A")
+	failOnError(t, err, "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aRestartingLeader(t *testing.T) {
+	numReplicas := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	dataDir := t.TempDir()
+	leaders := []*Leader{StartLeader(0, acceptorAddresses, "", dataDir, tcpTransport)}
+	leaderAddresses := []string{leaders[0].Address}
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	err := client0.TryLock(lockA)
+	failOnError(t, err, "")
+	leaders[0].mu.Lock()
+	usedBallot := leaders[0].ballot
+	leaders[0].mu.Unlock()
+	leaders[0].kill()
+
+	leaders[0] = StartLeader(0, acceptorAddresses, leaderAddresses[0], dataDir, tcpTransport)
+	leaders[0].mu.Lock()
+	if leaders[0].ballot.Compare(usedBallot) <= 0 {
+		t.Errorf("Restarted leader reuses ballot %+v, previously used %+v\n", leaders[0].ballot, usedBallot)
+	}
+	leaders[0].mu.Unlock()
+
+	// Slot 1 is answered from disk, without a commander
+	response := new(ReplicaResponse)
+	leaders[0].ExecutePropose(ReplicaRequest{Command: newLockCommand(1, 5, lockA, Unlock), Slot: 1}, response)
+	var decided LockCommand
+	decodeRecord(response.Command.Op, &decided)
+	if decided.LockName != lockA || decided.LockOp != Lock || decided.ClientID != 0 {
+		t.Errorf("Restarted leader answered slot 1 with %+v\n", decided)
+	}
+
+	err = client0.Unlock(lockA)
+	failOnError(t, err, "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aLeaderDownPastRetries(t *testing.T) {
+	numReplicas := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	dataDir := t.TempDir()
+	leaders := []*Leader{StartLeader(0, acceptorAddresses, "", dataDir, tcpTransport)}
+	leaderAddresses := []string{leaders[0].Address}
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	leaders[0].kill()
+	done := make(chan Err, 1)
+	go func() {
+		done <- client0.TryLock(lockA)
+	}()
+
+	// Longer than a proposal takes to run out of attempts
+	time.Sleep(3 * retransmitAttempts * retransmitMaxMillis * time.Millisecond / 2)
+	leaders[0] = StartLeader(0, acceptorAddresses, leaderAddresses[0], dataDir, tcpTransport)
+	select {
+	case err := <-done:
+		failOnError(t, err, "")
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Request proposed while the leader was down never completed\n")
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aCompaction(t *testing.T) {
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	dataDir := t.TempDir()
+	replicaAddresses := []string{reserveAddress()}
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	replicas := []*Replica{StartReplica(0, config, NewLockServer(), replicaAddresses[0], dataDir, tcpTransport)}
+	replicas[0].mu.Lock()
+	replicas[0].snapshotInterval = 4
+	replicas[0].mu.Unlock()
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+	failOnError(t, client0.TryLock("B"), "")
+	failOnError(t, client0.Unlock("B"), "")
+	failOnError(t, client0.TryLock("C"), "")
+	failOnError(t, client0.Unlock("C"), "")
+	failOnError(t, client0.TryLock("D"), "")
+
+	// Wait for the replica to find that slots 1 to 6 can be collected
+	time.Sleep(2 * compactionIntervalMillis * time.Millisecond)
+	leaders[0].mu.Lock()
+	if leaders[0].compactedSlot != 7 || len(leaders[0].decisions) != 0 {
+		t.Errorf("Leader compacted below %d, decisions %+v\n", leaders[0].compactedSlot, leaders[0].decisions)
+	}
+	leaders[0].mu.Unlock()
+	for _, acceptor := range acceptors {
+		acceptor.mu.Lock()
+		if acceptor.compactedSlot != 7 || len(acceptor.acceptedValues) != 0 {
+			t.Errorf("Acceptor compacted below %d, accepted %+v\n", acceptor.compactedSlot, acceptor.acceptedValues)
+		}
+		acceptor.mu.Unlock()
+	}
+
+	// The restarted replica loads the snapshot taken at slot 5 and replays slot 6
+	replicas[0].kill()
+	replicas[0] = StartReplica(0, config, NewLockServer(), replicaAddresses[0], dataDir, tcpTransport)
+	replicas[0].mu.Lock()
+	snapshotSlot := replicas[0].snapshotSlot
+	replicas[0].mu.Unlock()
+	if slotOut, locks := slotOutOf(replicas[0]), locksOf(replicas[0]); snapshotSlot != 5 || slotOut != 7 || len(locks) != 2 {
+		t.Errorf("Replica recovered snapshot %d, slot %d, locks %+v\n", snapshotSlot, slotOut, locks)
+	}
+
+	failOnError(t, client0.Unlock("A"), "")
+	failOnError(t, client0.Unlock("D"), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aCompactedAccept(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+
+	// The acceptors compacted slots the leader never heard about
+	for _, acceptor := range acceptors {
+		acceptor.mu.Lock()
+		acceptor.compactedSlot = 10
+		acceptor.mu.Unlock()
+	}
+	leaders[0].mu.Lock()
+	ballot := leaders[0].ballot
+	leaders[0].mu.Unlock()
+
+	// A commander for one of those slots stops right away, and the
+	// leader stays active
+	start := time.Now()
+	leaders[0].commander(5, Command{Kind: Noop, MsgID: 5, ClientID: noopClientID}, ballot, acceptorAddresses)
+	if time.Since(start) >= retransmitInitialMillis*time.Millisecond {
+		t.Errorf("Commander for a compacted slot took %v\n", time.Since(start))
+	}
+	leaders[0].mu.Lock()
+	if !leaders[0].active || leaders[0].ballot.Compare(ballot) != 0 {
+		t.Errorf("Leader active %t with ballot %+v after a compacted slot\n", leaders[0].active, leaders[0].ballot)
+	}
+	leaders[0].mu.Unlock()
+	cleanup(acceptors, leaders, replicas)
+}
+
+// Transport that records the procedures sent without a deadline
+type deadlineTransport struct {
+	Transport
+
+	mu sync.Mutex
+
+	// Procedures sent without a deadline
+	unbounded map[string]bool
+}
+
+func (transport *deadlineTransport) Send(Ctx context.Context, Address string, ProcedureName string, Request interface{}, Response interface{}) error {
+	if _, bounded := Ctx.Deadline(); !bounded {
+		transport.mu.Lock()
+		transport.unbounded[ProcedureName] = true
+		transport.mu.Unlock()
+	}
+	return transport.Transport.Send(Ctx, Address, ProcedureName, Request, Response)
+}
+
+func Test1c1r1l3aCompactionDeadlines(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	transport := &deadlineTransport{Transport: tcpTransport, unbounded: make(map[string]bool)}
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, transport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, transport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, transport)
+	time.Sleep(500 * time.Millisecond)
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, transport)
+	failOnError(t, client0.TryLock("A"), "")
+	failOnError(t, client0.Unlock("A"), "")
+
+	// Compaction requests give up on peers that hang, like the other
+	// requests that should be answered right away
+	time.Sleep(2 * compactionIntervalMillis * time.Millisecond)
+	for _, acceptor := range acceptors {
+		acceptor.mu.Lock()
+		if acceptor.compactedSlot != 3 {
+			t.Errorf("Acceptor compacted below %d\n", acceptor.compactedSlot)
+		}
+		acceptor.mu.Unlock()
+	}
+	transport.mu.Lock()
+	for _, procedureName := range []string{"Leader.ExecuteCompact", "Acceptor.ExecuteCompact"} {
+		if transport.unbounded[procedureName] {
+			t.Errorf("%s was sent without a deadline\n", procedureName)
+		}
+	}
+	transport.mu.Unlock()
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c2r1l3aSnapshotTransfer(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	replicas[0].mu.Lock()
+	replicas[0].snapshotLag = 2
+	replicas[0].snapshotChunkSize = 16
+	replicas[0].mu.Unlock()
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	replicas[1].kill()
+	failOnError(t, client0.TryLock("A"), "")
+	failOnError(t, client0.TryLock("B"), "")
+	failOnError(t, client0.Unlock("B"), "")
+	failOnError(t, client0.TryLock("C"), "")
+
+	// The leader can't help a brand new replica in place of replica 1,
+	// so it is sent a snapshot by replica 0
+	leaders[0].ExecuteCompact(CompactRequest{Slot: 5}, new(CompactResponse))
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	replicas[1] = JoinReplica(1, config, NewLockServer(), replicaAddresses[1], "", tcpTransport)
+	time.Sleep(3 * compactionIntervalMillis * time.Millisecond)
+	replicas[1].mu.Lock()
+	result := replicas[1].clientResults[0]
+	replicas[1].mu.Unlock()
+	client0.mu.Lock()
+	lastMsgID := client0.msgID - 1
+	client0.mu.Unlock()
+	if slotOut, locks := slotOutOf(replicas[1]), locksOf(replicas[1]); slotOut != 5 || len(locks) != 2 || result.MsgID != lastMsgID {
+		t.Errorf("Replica installed slot %d, locks %+v, result %+v\n", slotOut, locks, result)
+	}
+
+	replicas[0].kill()
+	failOnError(t, client0.Unlock("A"), "")
+	failOnError(t, client0.Unlock("C"), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aInstallSnapshotChecks(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	// A snapshot without a results table
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	frame, err := encodeFrame(replicaSnapshot{
+		SlotOut: 2,
+		State:   NewLockServer().Snapshot(),
+		Configs: map[int]Configuration{1: config},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode a snapshot, %s\n", err)
+	}
+
+	// A corrupt snapshot is dropped
+	corrupt := append([]byte(nil), frame...)
+	corrupt[len(corrupt)-1] ^= 1
+	request := InstallSnapshotRequest{ReplicaID: 1, SlotOut: 2, Data: corrupt, Done: true}
+	if replicas[0].InstallSnapshot(request, new(InstallSnapshotResponse)) == nil {
+		t.Errorf("Corrupt snapshot was installed\n")
+	}
+	request.Data = frame
+	if err := replicas[0].InstallSnapshot(request, new(InstallSnapshotResponse)); err != nil {
+		t.Fatalf("Failed to install the snapshot, %s\n", err)
+	}
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c3r1l4aReconfiguration(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+
+	// Replace the dead acceptor 0 with a new one and add a replica
+	acceptors[0].kill()
+	acceptors = append(acceptors, StartAcceptor(numAcceptors, "", "", tcpTransport))
+	newReplicaAddress := reserveAddress()
+	config := Configuration{
+		Acceptors: []string{acceptorAddresses[1], acceptorAddresses[2], acceptors[numAcceptors].Address},
+		Leaders:   leaderAddresses,
+		Replicas:  []string{replicaAddresses[0], replicaAddresses[1], newReplicaAddress},
+	}
+	replicas = append(replicas, JoinReplica(numReplicas, config, NewLockServer(), newReplicaAddress, "", tcpTransport))
+	failOnError(t, client0.Reconfigure(config), "")
+
+	// Move past the slots still decided under the old configuration
+	for i := 0; i < defaultWindow; i++ {
+		failOnError(t, client0.TryLock("B"), "")
+		failOnError(t, client0.Unlock("B"), "")
+	}
+	if replicas := client0.currentReplicas(); len(replicas) != numReplicas+1 {
+		t.Errorf("Client did not learn the new replicas, %+v\n", replicas)
+	}
+
+	// Once the old configuration is compacted away it doesn't need a majority
+	time.Sleep(3 * compactionIntervalMillis * time.Millisecond)
+	leaders[0].mu.Lock()
+	if len(leaders[0].configs) != 1 {
+		t.Errorf("Leader still has configurations %+v\n", leaders[0].configs)
+	}
+	leaders[0].mu.Unlock()
+	acceptors[1].kill()
+	failOnError(t, client0.Unlock("A"), "")
+
+	time.Sleep(500 * time.Millisecond)
+	if slotOut, locks := slotOutOf(replicas[numReplicas]), locksOf(replicas[numReplicas]); slotOut != slotOutOf(replicas[0]) || len(locks) != 0 {
+		t.Errorf("New replica is at slot %d, locks %+v\n", slotOut, locks)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aInvalidReconfiguration(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	if err := client0.Reconfigure(Configuration{Acceptors: acceptorAddresses, Replicas: replicaAddresses}); err != ErrInvalidConfig {
+		t.Errorf("Reconfiguration without leaders returned %s\n", err)
+	}
+	response := new(ClientResponse)
+	replicas[0].ExecuteRequest(ClientRequest{Command: Command{Kind: Reconfigure, ClientID: 1, MsgID: 1}}, response)
+	if response.Err != ErrInvalidConfig {
+		t.Errorf("Reconfiguration without a configuration returned %s\n", response.Err)
+	}
+
+	// Neither was proposed
+	failOnError(t, client0.TryLock("A"), "")
+	if slotOut := slotOutOf(replicas[0]); slotOut != 2 {
+		t.Errorf("Replica applied up to slot %d\n", slotOut)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test6c1r1l3aWindow(t *testing.T) {
+	numLeaders := 1
+	numAcceptors := 3
+	numClients := 6
+	window := 2
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses := []string{reserveAddress()}
+	config := Configuration{
+		Acceptors: acceptorAddresses,
+		Leaders:   leaderAddresses,
+		Replicas:  replicaAddresses,
+		Window:    window,
+	}
+	replicas := []*Replica{StartReplica(0, config, NewLockServer(), replicaAddresses[0], "", tcpTransport)}
+	time.Sleep(500 * time.Millisecond)
+
+	// A burst of requests is proposed at most window slots at a time
+	errChan := make(chan Err, numClients)
+	for i := 0; i < numClients; i++ {
+		client := StartClient(i, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+		go client.ChanneledLock(string(rune('A'+i)), errChan)
+	}
+	for received := 0; received < numClients; {
+		select {
+		case err := <-errChan:
+			failOnError(t, err, "")
+			received++
+		case <-time.After(time.Millisecond):
+			replicas[0].mu.Lock()
+			if outstanding := replicas[0].slotIn - replicas[0].slotOut; outstanding > window {
+				t.Errorf("Replica has %d slots outstanding\n", outstanding)
+			}
+			replicas[0].mu.Unlock()
+		}
+	}
+
+	if slotOut, locks := slotOutOf(replicas[0]), locksOf(replicas[0]); slotOut != numClients+1 || len(locks) != numClients {
+		t.Errorf("Replica applied up to slot %d, locks %+v\n", slotOut, locks)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aRestartingClient(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+	failOnError(t, client0.Unlock("A"), "")
+
+	// The client restarted with the same id is not answered from the
+	// results of its previous run
+	client0 = StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("B"), "")
+	if slotOut, locks := slotOutOf(replicas[0]), locksOf(replicas[0]); slotOut != 4 || len(locks) != 1 || locks["B"] != 0 {
+		t.Errorf("Replica applied up to slot %d, locks %+v\n", slotOut, locks)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c1r1l3aDuplicateRequests(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+	client0.mu.Lock()
+	lockA := newLockCommand(0, client0.msgID-1, "A", Lock)
+	client0.mu.Unlock()
+
+	// A retry is answered from the results without being proposed
+	response := new(ClientResponse)
+	if err := replicas[0].ExecuteRequest(ClientRequest{Command: lockA}, response); err != nil || lockResult(response.Result, response.Err) != OK {
+		t.Errorf("Retry got %+v, %v\n", response, err)
+	}
+	replicas[0].mu.Lock()
+	if replicas[0].slotIn != 2 {
+		t.Errorf("Retry was proposed in slot %d\n", replicas[0].slotIn)
+	}
+	replicas[0].mu.Unlock()
+
+	// The lock is decided a second time after it was unlocked, which
+	// must not give it back to client 0
+	failOnError(t, client0.Unlock("A"), "")
+	leaders[0].ExecutePropose(ReplicaRequest{Command: lockA, Slot: 3}, new(ReplicaResponse))
+	failOnError(t, client1.TryLock("A"), "")
+	if slotOut, locks := slotOutOf(replicas[0]), locksOf(replicas[0]); slotOut != 5 || locks["A"] != 1 {
+		t.Errorf("Replica applied up to slot %d, locks %+v\n", slotOut, locks)
+	}
+	failOnError(t, client1.Unlock("A"), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+// State machine that adds the operations it is sent to a counter
+type counter struct {
+	value int
+}
+
+func (thisCounter *counter) Apply(command []byte) []byte {
+	delta, err := strconv.Atoi(string(command))
+	if err != nil {
+		return []byte(ErrInvalidCommand)
+	}
+	thisCounter.value += delta
+	return []byte(strconv.Itoa(thisCounter.value))
+}
+
+func (thisCounter *counter) Snapshot() []byte {
+	return []byte(strconv.Itoa(thisCounter.value))
+}
+
+func (thisCounter *counter) Restore(snapshot []byte) (err error) {
+	thisCounter.value, err = strconv.Atoi(string(snapshot))
+	return err
+}
+
+func Test1c2r1l3aCounterStateMachine(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses := []string{reserveAddress(), reserveAddress()}
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	dataDirs := []string{"", t.TempDir()}
+	replicas := make([]*Replica, numReplicas)
+	for i := 0; i < numReplicas; i++ {
+		replicas[i] = StartReplica(i, config, &counter{}, replicaAddresses[i], dataDirs[i], tcpTransport)
+	}
+	replicas[1].mu.Lock()
+	replicas[1].snapshotInterval = 2
+	replicas[1].mu.Unlock()
+	time.Sleep(500 * time.Millisecond)
+
+	// Only the operations of the lock server are in protobuf
+	if _, err := replicas[0].ServeGRPC("localhost:0"); err == nil {
+		t.Errorf("Replica of a counter served gRPC\n")
+	}
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	for i, expected := range []string{"1", "3", "6"} {
+		result, err := client0.Execute([]byte(strconv.Itoa(i + 1)))
+		failOnError(t, err, "")
+		if string(result) != expected {
+			t.Errorf("Counter returned %s, expected %s\n", result, expected)
+		}
+	}
+	result, err := client0.Execute([]byte("three"))
+	if err != OK || string(result) != ErrInvalidCommand {
+		t.Errorf("Counter returned %s, %s for an invalid operation\n", result, err)
+	}
+
+	// The restarted replica restores the counter from its snapshot
+	time.Sleep(500 * time.Millisecond)
+	replicas[1].kill()
+	replicas[1] = StartReplica(1, config, &counter{}, replicaAddresses[1], dataDirs[1], tcpTransport)
+	replicas[1].mu.Lock()
+	if value := replicas[1].stateMachine.(*counter).value; value != 6 {
+		t.Errorf("Replica recovered counter %d\n", value)
+	}
+	replicas[1].mu.Unlock()
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c3r1l3aKeyValueStore(t *testing.T) {
+	numReplicas := 3
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses := make([]string, numReplicas)
+	for i := range replicaAddresses {
+		replicaAddresses[i] = reserveAddress()
+	}
+	config := Configuration{Acceptors: acceptorAddresses, Leaders: leaderAddresses, Replicas: replicaAddresses}
+	replicas := make([]*Replica, numReplicas)
+	for i := range replicas {
+		replicas[i] = StartReplica(i, config, NewKVStore(), replicaAddresses[i], "", tcpTransport)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartKVClient(0, replicaAddresses, tcpTransport)
+	client1 := StartKVClient(1, replicaAddresses, tcpTransport)
+	if _, err := client0.Get("config"); err != ErrNoKey {
+		t.Errorf("Get of a missing key returned %s\n", err)
+	}
+	failOnError(t, client0.Put("config", "v1"), "")
+	value, err := client1.Get("config")
+	failOnError(t, err, "")
+	if value != "v1" {
+		t.Errorf("Get returned %s, expected v1\n", value)
+	}
+
+	// Only one of two clients racing from the same value wins
+	replicas[0].kill()
+	_, err = client0.CompareAndSwap("config", "v1", "v2")
+	failOnError(t, err, "")
+	value, err = client1.CompareAndSwap("config", "v1", "v3")
+	if err != ErrCompareFailed || value != "v2" {
+		t.Errorf("Losing CompareAndSwap returned %s, %s\n", value, err)
+	}
+
+	failOnError(t, client1.Delete("config"), "")
+	if err = client0.Delete("config"); err != ErrNoKey {
+		t.Errorf("Second Delete returned %s\n", err)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c2r1l3aLockLeases(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLockFor("A", 500*time.Millisecond), "")
+	failOnError(t, client0.TryLock("B"), "")
+	if err := client1.TryLock("A"); err != ErrLockHeld {
+		t.Errorf("Lock under lease returned %s\n", err)
+	}
+
+	// client0 does not renew its lease, which runs out, but the plain lock stays
+	time.Sleep(1500 * time.Millisecond)
+	failOnError(t, client1.TryLock("A"), "")
+	if err := client1.TryLock("B"); err != ErrLockHeld {
+		t.Errorf("Lock without a lease returned %s\n", err)
+	}
+
+	// Both replicas expired the lease through the log
+	time.Sleep(500 * time.Millisecond)
+	for _, replica := range replicas {
+		locks := locksOf(replica)
+		replica.mu.Lock()
+		needsTicks := replica.stateMachine.(*LockServer).NeedsTicks()
+		replica.mu.Unlock()
+		if locks["A"] != 1 || locks["B"] != 0 || needsTicks {
+			t.Errorf("Replica %d has locks %+v\n", replica.replicaID, locks)
+		}
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func TestLockServerLockWaitsInLine(t *testing.T) {
+	lockServer := NewLockServer()
+	apply := func(lockCommand LockCommand) LockResult {
+		return decodeLockResult(lockServer.Apply(encodeLockCommand(0, lockCommand).Op), OK)
+	}
+
+	// Client 1 waits to lock the tree under /a, which client 0 keeps
+	// from it by holding /a/b
+	apply(LockCommand{LockName: "/a/b", LockOp: Lock, ClientID: 0})
+	apply(LockCommand{LockName: "/a", LockOp: Lock, ClientID: 1, Tree: true, Wait: true})
+
+	// Client 2 could have /a itself, but does not get it ahead of client 1
+	if result := apply(LockCommand{LockName: "/a", LockOp: Lock, ClientID: 2}); result.Err != ErrLockHeld {
+		t.Errorf("Expected %s, got %+v\n", ErrLockHeld, result)
+	}
+	apply(LockCommand{LockName: "/a", LockOp: Lock, ClientID: 2, Wait: true})
+	lockServer.Events()
+
+	// Client 1 gets /a once client 0 unlocked /a/b, then client 2
+	apply(LockCommand{LockName: "/a/b", LockOp: Unlock, ClientID: 0})
+	apply(LockCommand{LockName: "/a", LockOp: Unlock, ClientID: 1})
+	granted := make([]int, 0)
+	for _, event := range lockServer.Events() {
+		if event.Kind == Acquired {
+			granted = append(granted, event.ClientID)
+		}
+	}
+	if !reflect.DeepEqual(granted, []int{1, 2}) {
+		t.Errorf("Lock /a granted to %v\n", granted)
+	}
+}
+
+func TestLockServerSessionEndOrder(t *testing.T) {
+	lockServer := NewLockServer()
+	apply := func(lockCommand LockCommand) {
+		lockServer.Apply(encodeLockCommand(0, lockCommand).Op)
+	}
+	apply(LockCommand{LockOp: OpenSession, ClientID: 1, TTLMillis: 60000})
+
+	// Client 1 waits at the head of every queue, and client 3 behind it
+	lockNames := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		lockName := "/lock-" + strconv.Itoa(10+i)
+		lockNames = append(lockNames, lockName)
+		apply(LockCommand{LockName: lockName, LockOp: RLock, ClientID: 2})
+		apply(LockCommand{LockName: lockName, LockOp: Lock, ClientID: 1, Wait: true})
+		apply(LockCommand{LockName: lockName, LockOp: RLock, ClientID: 3, Wait: true})
+	}
+	lockServer.Events()
+
+	// Every replica grants the locks to client 3 in the same order
+	apply(LockCommand{LockOp: CloseSession, ClientID: 1})
+	granted := make([]string, 0)
+	for _, event := range lockServer.Events() {
+		if event.Kind == Acquired && event.ClientID == 3 {
+			granted = append(granted, event.Name)
+		}
+	}
+	if !reflect.DeepEqual(granted, lockNames) {
+		t.Errorf("Locks granted in order %v\n", granted)
+	}
+}
+
+func Test2c2r1l3aSessions(t *testing.T) {
+	numReplicas := 2
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.StartSession(500*time.Millisecond), "")
+	failOnError(t, client0.TryLock("A"), "")
+	failOnError(t, client0.TryLock("B"), "")
+
+	// Keep alives hold on to the locks for longer than the TTL
+	time.Sleep(1500 * time.Millisecond)
+	if err := client1.TryLock("A"); err != ErrLockHeld {
+		t.Errorf("Lock of a live session returned %s\n", err)
+	}
+
+	// client0 crashes, so its session expires and its locks are released
+	client0.mu.Lock()
+	close(client0.session)
+	client0.session = nil
+	client0.mu.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	failOnError(t, client1.TryLock("A"), "")
+	failOnError(t, client1.TryLock("B"), "")
+	if err := client0.EndSession(); err != ErrSessionExpired {
+		t.Errorf("Ending an expired session returned %s\n", err)
+	}
+
+	// Ending a session releases the locks right away
+	failOnError(t, client1.StartSession(time.Minute), "")
+	failOnError(t, client1.EndSession(), "")
+	failOnError(t, client0.TryLock("A"), "")
+	time.Sleep(500 * time.Millisecond)
+	for _, replica := range replicas {
+		if locks := locksOf(replica); len(locks) != 1 || locks["A"] != 0 {
+			t.Errorf("Replica %d has locks %+v\n", replica.replicaID, locks)
+		}
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c1r1l3aSessionWhileWaiting(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.StartSession(500*time.Millisecond), "")
+	failOnError(t, client0.TryLock("B"), "")
+	failOnError(t, client1.TryLock("A"), "")
+
+	// Keep alives go on while client0 waits for A for longer than the TTL
+	granted := make(chan int64, 1)
+	go func() {
+		granted <- client0.Lock("A")
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	failOnError(t, client1.Unlock("A"), "")
+	<-granted
+	if locks := locksOf(replicas[0]); len(locks) != 2 || locks["A"] != 0 || locks["B"] != 0 {
+		t.Errorf("Replica has locks %+v\n", locks)
+	}
+	failOnError(t, client0.EndSession(), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c1r1l3aFencingTokens(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	tokenA, err := client0.TryLockFenced("A")
+	failOnError(t, err, "")
+	tokenB, err := client1.TryLockFenced("B")
+	failOnError(t, err, "")
+	again, err := client0.TryLockFenced("A")
+	failOnError(t, err, "")
+	if tokenB <= tokenA || again != tokenA {
+		t.Errorf("Got tokens %d, %d, then %d\n", tokenA, tokenB, again)
+	}
+
+	// The next holder of A gets a higher token than the previous one
+	failOnError(t, client0.Unlock("A"), "")
+	if token := client1.Lock("A"); token <= tokenB {
+		t.Errorf("Got token %d after %d\n", token, tokenB)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test3c1r1l3aWaitQueues(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client2 := StartClient(2, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	token0, err := client0.TryLockFenced("A")
+	failOnError(t, err, "")
+
+	// Clients 1 and 2 wait in line for A, in that order
+	granted := make(chan int, 2)
+	for _, client := range []*Client{client1, client2} {
+		go func(client *Client) {
+			token := client.Lock("A")
+			if token <= token0 {
+				t.Errorf("Client %d got token %d after %d\n", client.clientID, token, token0)
+			}
+			granted <- client.clientID
+			failOnError(t, client.Unlock("A"), "")
+		}(client)
+		time.Sleep(500 * time.Millisecond)
+	}
+	failOnError(t, client0.Unlock("A"), "")
+	if first, second := <-granted, <-granted; first != 1 || second != 2 {
+		t.Errorf("Lock granted to %d then %d\n", first, second)
+	}
+
+	// Three locks and three unlocks, without any retries
+	time.Sleep(500 * time.Millisecond)
+	if slotOut, locks := slotOutOf(replicas[0]), locksOf(replicas[0]); slotOut != 7 || len(locks) != 0 {
+		t.Errorf("Replica applied up to slot %d, locks %+v\n", slotOut, locks)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test3c1r1l3aSharedLocks(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client2 := StartClient(2, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+
+	// Readers hold A at the same time, and keep writers out
+	token0 := client0.RLock("A")
+	if token1 := client1.RLock("A"); token1 != token0 {
+		t.Errorf("Readers got tokens %d and %d\n", token0, token1)
+	}
+	if err := client2.TryLock("A"); err != ErrLockHeld {
+		t.Errorf("Expected %s, got %s\n", ErrLockHeld, err)
+	}
+	if err := client2.RUnlock("A"); err != ErrInvalidUnlock {
+		t.Errorf("Expected %s, got %s\n", ErrInvalidUnlock, err)
+	}
+
+	// The writer gets A once both readers released it
+	granted := make(chan int64, 1)
+	go func() {
+		granted <- client2.Lock("A")
+	}()
+	time.Sleep(500 * time.Millisecond)
+	failOnError(t, client0.RUnlock("A"), "")
+	select {
+	case <-granted:
+		t.Errorf("Writer got the lock while it was held shared\n")
+	case <-time.After(500 * time.Millisecond):
+	}
+	failOnError(t, client1.RUnlock("A"), "")
+	if token2 := <-granted; token2 <= token0 {
+		t.Errorf("Writer got token %d after %d\n", token2, token0)
+	}
+	if locks := locksOf(replicas[0]); locks["A"] != 2 {
+		t.Errorf("Replica has locks %+v\n", locks)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c1r1l3aLockHierarchy(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+
+	// A tree cannot be locked while someone else holds a lock under it
+	failOnError(t, client1.TryLock("/svc/db/shard-3"), "")
+	if err := client0.TryLockTree("/svc/db"); err != ErrLockHeld {
+		t.Errorf("Expected %s, got %s\n", ErrLockHeld, err)
+	}
+	failOnError(t, client1.Unlock("/svc/db/shard-3"), "")
+	failOnError(t, client0.TryLockTree("/svc/db"), "")
+
+	// And nothing under it can be locked while it is held
+	if err := client1.TryLock("/svc/db/shard-1"); err != ErrLockHeld {
+		t.Errorf("Expected %s, got %s\n", ErrLockHeld, err)
+	}
+	failOnError(t, client1.TryLock("/svc/dbx"), "")
+	client1.RLock("/svc/web/config")
+	holders, err := client0.ListLocks("/svc")
+	failOnError(t, err, "")
+	expected := []LockHolder{
+		{LockName: "/svc/db", ClientID: 0},
+		{LockName: "/svc/dbx", ClientID: 1},
+		{LockName: "/svc/web/config", ClientID: 1, Shared: true},
+	}
+	if !reflect.DeepEqual(holders, expected) {
+		t.Errorf("Listed %+v\n", holders)
+	}
+
+	// A client waiting under the tree gets its lock once the tree is
+	// released
+	granted := make(chan int64, 1)
+	go func() {
+		granted <- client1.Lock("/svc/db/shard-1")
+	}()
+	time.Sleep(500 * time.Millisecond)
+	failOnError(t, client0.Unlock("/svc/db"), "")
+	<-granted
+	holders, err = client0.ListLocks("/svc/db")
+	failOnError(t, err, "")
+	if !reflect.DeepEqual(holders, []LockHolder{{LockName: "/svc/db/shard-1", ClientID: 1}}) {
+		t.Errorf("Listed %+v\n", holders)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c1r1l3aWatch(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	client1 := StartClient(1, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	events := make(chan Event, ChannelBufferSize)
+	stop := make(chan bool)
+	defer close(stop)
+	go client1.Watch("/svc", events, stop)
+	time.Sleep(500 * time.Millisecond)
+
+	failOnError(t, client0.TryLockFor("/svc/a", 300*time.Millisecond), "")
+	failOnError(t, client0.TryLock("/other"), "")
+	client0.Lock("/svc/b")
+	failOnError(t, client0.Unlock("/svc/b"), "")
+	expected := []Event{
+		{Name: "/svc/a", Kind: Acquired, ClientID: 0},
+		{Name: "/svc/b", Kind: Acquired, ClientID: 0},
+		{Name: "/svc/b", Kind: Released, ClientID: 0},
+		{Name: "/svc/a", Kind: Expired, ClientID: 0},
+	}
+	for i, want := range expected {
+		select {
+		case event := <-events:
+			event.Slot = 0
+			if event != want {
+				t.Errorf("Event %d is %+v, expected %+v\n", i, event, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for event %d %+v\n", i, want)
+		}
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test2c3r1l3aQuery(t *testing.T) {
+	numReplicas := 3
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	// Only the first replica hears about the locks
+	for msgID, lockName := range []string{"/svc/a", "/svc/b"} {
+		response := new(ClientResponse)
+		replicas[0].ExecuteRequest(ClientRequest{Command: newLockCommand(0, msgID+1, lockName, Lock)}, response)
+		failOnError(t, lockResult(response.Result, response.Err), "")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if slotOut := slotOutOf(replicas[1]); slotOut != 1 {
+		t.Fatalf("Replica learned up to slot %d\n", slotOut)
+	}
+
+	// The second replica learns them to answer, without using a slot
+	client1 := StartClient(1, replicaAddresses[1:2], timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	holders, err := client1.QueryLocks("/svc")
+	failOnError(t, err, "")
+	expected := []LockHolder{{LockName: "/svc/a", ClientID: 0}, {LockName: "/svc/b", ClientID: 0}}
+	if !reflect.DeepEqual(holders, expected) {
+		t.Errorf("Queried %+v\n", holders)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if slotOut0, slotOut1 := slotOutOf(replicas[0]), slotOutOf(replicas[1]); slotOut0 != 3 || slotOut1 != 3 {
+		t.Errorf("Replicas applied up to slots %d and %d\n", slotOut0, slotOut1)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r3l3aLeaderLeases(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 3
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock(lockA), "")
+	failOnError(t, client0.Unlock(lockA), "")
+	time.Sleep(2 * leaderLeaseMillis * time.Millisecond)
+
+	// Exactly one leader is active, and the others forward to it
+	active := -1
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		if leader.active {
+			if active >= 0 {
+				t.Errorf("Leaders %d and %d are both active\n", active, i)
+			}
+			active = i
+		}
+		leader.mu.Unlock()
+	}
+	if active < 0 {
+		t.Fatalf("No leader is active\n")
+	}
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		if i != active && leader.leaseHolder != leaders[active].Address {
+			t.Errorf("Leader %d forwards to %q, expected %q\n", i, leader.leaseHolder, leaders[active].Address)
+		}
+		leader.mu.Unlock()
+	}
+
+	// Once its lease runs out, another leader takes over
+	leaders[active].kill()
+	failOnError(t, client0.TryLock(lockA), "")
+	time.Sleep(2 * leaderLeaseMillis * time.Millisecond)
+	takenOver := false
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		takenOver = takenOver || (i != active && leader.active)
+		leader.mu.Unlock()
+	}
+	if !takenOver {
+		t.Errorf("No leader took over from leader %d\n", active)
+	}
+	failOnError(t, client0.Unlock(lockA), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r1l3aSplitLeases(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	// One acceptor is leased to a leader that is gone, the other two still
+	// make a majority
+	acceptors[2].mu.Lock()
+	acceptors[2].leaseHolder = reserveAddress()
+	acceptors[2].leaseExpiry = time.Now().Add(time.Hour)
+	acceptors[2].mu.Unlock()
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+
+	for start := time.Now(); time.Since(start) < 2*leaderLeaseMillis*time.Millisecond; time.Sleep(time.Millisecond) {
+		leaders[0].mu.Lock()
+		leaseHolder := leaders[0].leaseHolder
+		leaders[0].mu.Unlock()
+		if leaseHolder != "" {
+			t.Fatalf("Leader went passive for the lease of a single acceptor\n")
+		}
+	}
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock("A"), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r2l3aHungLeaseHolder(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 2
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock(lockA), "")
+	time.Sleep(2 * leaderLeaseMillis * time.Millisecond)
+	active := 0
+	leaders[1].mu.Lock()
+	if leaders[1].active {
+		active = 1
+	}
+	leaders[1].mu.Unlock()
+
+	// The lease holder stops answering anything without closing its
+	// connections, so the passive leader's forwards hang until it gives
+	// up on the lease holder
+	leaders[active].mu.Lock()
+	done := make(chan Err, 1)
+	go func() {
+		done <- client0.Unlock(lockA)
+	}()
+	select {
+	case err := <-done:
+		failOnError(t, err, "")
+	case <-time.After(10 * time.Second):
+		t.Errorf("Request forwarded to a hung lease holder never completed\n")
+	}
+	leaders[active].mu.Unlock()
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c1r3l3aLeaderFailover(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 3
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	failOnError(t, client0.TryLock(lockA), "")
+	time.Sleep(2 * leaderLeaseMillis * time.Millisecond)
+
+	// The passive leaders keep getting heartbeats, so they don't scout
+	active := -1
+	ballots := make([]Ballot, numLeaders)
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		if leader.active {
+			active = i
+		}
+		ballots[i] = leader.ballot
+		leader.mu.Unlock()
+	}
+	if active < 0 {
+		t.Fatalf("No leader is active\n")
+	}
+	time.Sleep(2 * leaderLeaseMillis * time.Millisecond)
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		if leader.ballot.Compare(ballots[i]) != 0 || leader.active != (i == active) {
+			t.Errorf("Leader %d moved to ballot %+v, active %t\n", i, leader.ballot, leader.active)
+		}
+		leader.mu.Unlock()
+	}
+
+	// Without any requests from the replicas, another leader takes over
+	// once the heartbeats stop
+	leaders[active].kill()
+	time.Sleep(4 * leaderLeaseMillis * time.Millisecond)
+	takenOver := 0
+	for i, leader := range leaders {
+		leader.mu.Lock()
+		if i != active && leader.active {
+			takenOver++
+		}
+		leader.mu.Unlock()
+	}
+	if takenOver != 1 {
+		t.Errorf("%d leaders took over from leader %d, expected 1\n", takenOver, active)
+	}
+	failOnError(t, client0.Unlock(lockA), "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+func Test1c3r3l3aMemoryTransport(t *testing.T) {
+	numReplicas := 3
+	numLeaders := 3
+	numAcceptors := 3
+
+	// The whole cluster runs in the process, without opening any ports
+	transport := NewMemoryTransport()
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, transport)
+	for _, address := range acceptorAddresses {
+		if !strings.HasPrefix(address, "memory:") {
+			t.Fatalf("Acceptor got address %s from the in-memory transport\n", address)
+		}
+	}
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, transport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, transport)
+	for _, address := range replicaAddresses {
+		if !strings.HasPrefix(address, "memory:") {
+			t.Fatalf("Replica got address %s from the in-memory transport\n", address)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	lockA := "A"
+	lockB := "B"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, transport)
+	err := client0.TryLock(lockA)
+	failOnError(t, err, "")
+	acceptors[0].kill()
+	leaders[1].kill()
+	err = client0.TryLock(lockB)
+	failOnError(t, err, "")
+
+	// A killed server is cut off, and its address can be served again
+	done := make(chan interface{}, 1)
+	request := ReadIndexRequest{Address: acceptorAddresses[0]}
+	Call(transport, acceptorAddresses[0], "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	if <-done != false {
+		t.Errorf("Call to a killed acceptor succeeded\n")
+	}
+	acceptors[0] = StartAcceptor(0, acceptorAddresses[0], "", transport)
+	Call(transport, acceptorAddresses[0], "Acceptor.ExecuteReadIndex", request, new(ReadIndexResponse), done)
+	if <-done == false {
+		t.Errorf("Call to the restarted acceptor failed\n")
+	}
+
+	err = client0.Unlock(lockA)
+	failOnError(t, err, "")
+	err = client0.Unlock(lockB)
+	failOnError(t, err, "")
+	cleanup(acceptors, leaders, replicas)
+}
+
+// Makes a unary gRPC call over HTTP/2 without TLS, the way the gRPC
+// clients of other languages do. Returns the response message and the
+// status code.
+func callGRPC(address string, method string, request []byte, timeout string) (response []byte, status string, err error) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	frame := new(bytes.Buffer)
+	if err = writeGRPCMessage(frame, request); err != nil {
+		return nil, "", err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, "http://"+address+method, frame)
+	if err != nil {
+		return nil, "", err
+	}
+	httpRequest.Header.Set("Content-Type", "application/grpc+proto")
+	httpRequest.Header.Set("Te", "trailers")
+	if timeout != "" {
+		httpRequest.Header.Set("Grpc-Timeout", timeout)
+	}
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, "", err
+	}
+	defer httpResponse.Body.Close()
+	body, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > 0 {
+		if response, err = readGRPCMessage(bytes.NewReader(body)); err != nil {
+			return nil, "", err
+		}
+	}
+	return response, httpResponse.Trailer.Get("Grpc-Status"), nil
+}
+
+// Sends a lock operation through the LockServer service. Returns the err
+// and token fields of the response, and the status code.
+func grpcLock(t *testing.T, address string, msgID int, lockCommand LockCommand, timeout string) (err Err, token int64, status string) {
+	var command, request protoWriter
+	command.string(1, lockCommand.LockName)
+	command.string(2, string(lockCommand.LockOp))
+	command.int64(3, int64(lockCommand.ClientID))
+	command.bool(5, lockCommand.Wait)
+	request.message(1, command.data)
+	request.int64(2, int64(msgID))
+	response, status, callErr := callGRPC(address, "/lspaxos.LockServer/Execute", request.data, timeout)
+	if callErr != nil {
+		t.Fatalf("gRPC call failed, %s\n", callErr)
+	}
+	decodeErr := readProto(response, func(reader *protoReader, field int) (bool, error) {
+		var value string
+		var decodeErr error
+		switch field {
+		case 1:
+			value, decodeErr = reader.string()
+			err = Err(value)
+		case 3:
+			token, decodeErr = reader.int64()
+		default:
+			return false, nil
+		}
+		return true, decodeErr
+	})
+	if decodeErr != nil {
+		t.Fatalf("Failed to decode gRPC response, %s\n", decodeErr)
+	}
+	return err, token, status
+}
+
+func Test2c1r1l3aGRPC(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	replicaAddresses, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	address, serveErr := replicas[0].ServeGRPC("localhost:0")
+	if serveErr != nil {
+		t.Fatalf("Failed to serve gRPC, %s\n", serveErr)
+	}
+
+	// A gRPC client and a net/rpc client contend for the same lock
+	lockA := "A"
+	client0 := StartClient(0, replicaAddresses, timeoutMillis, timeoutMillisAddInc, timeoutMillisMultDec, tcpTransport)
+	err, token, status := grpcLock(t, address, 1, LockCommand{LockName: lockA, LockOp: Lock, ClientID: 7}, "")
+	if err != OK || status != "0" || token <= 0 {
+		t.Fatalf("gRPC lock returned %s, token %d, status %s\n", err, token, status)
+	}
+	if err := client0.TryLock(lockA); err != ErrLockHeld {
+		t.Errorf("Lock held over gRPC was granted, %s\n", err)
+	}
+
+	// A request resent with the same message id is answered from the
+	// result of the first one
+	if err, resentToken, _ := grpcLock(t, address, 1, LockCommand{LockName: lockA, LockOp: Lock, ClientID: 7}, ""); err != OK || resentToken != token {
+		t.Errorf("Resent gRPC lock returned %s, token %d\n", err, resentToken)
+	}
+
+	// Waiting for a held lock gives up at the deadline of the call, and
+	// so does a retry while the lock is still held
+	waitingLock := LockCommand{LockName: lockA, LockOp: Lock, ClientID: 9, Wait: true}
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, _, status = grpcLock(t, address, 1, waitingLock, "200m"); status != "4" {
+			t.Errorf("Expected the waiting lock to exceed its deadline, status %s\n", status)
+		}
+	}
+	if _, status, _ = callGRPC(address, "/lspaxos.Replica/ExecuteRequest", nil, ""); status != "12" {
+		t.Errorf("Replica.ExecuteRequest, which gRPC clients can't encode, returned status %s\n", status)
+	}
+
+	// Once the lock is released, a retry with the same message id gets
+	// the grant the client waited for
+	err, _, _ = grpcLock(t, address, 2, LockCommand{LockName: lockA, LockOp: Unlock, ClientID: 7}, "")
+	failOnError(t, err, "")
+	if err, grantedToken, status := grpcLock(t, address, 1, waitingLock, "200m"); err != OK || status != "0" || grantedToken <= token {
+		t.Errorf("Retried waiting lock returned %s, token %d, status %s\n", err, grantedToken, status)
+	}
+	if err := client0.TryLock(lockA); err != ErrLockHeld {
+		t.Errorf("Lock was not granted to the waiting client, %s\n", err)
+	}
+	err, _, _ = grpcLock(t, address, 2, LockCommand{LockName: lockA, LockOp: Unlock, ClientID: 9}, "")
+	failOnError(t, err, "")
+	failOnError(t, client0.TryLock(lockA), "")
+
+	// The gRPC endpoint goes away with the replica
+	cleanup(acceptors, leaders, replicas)
+	if _, _, callErr := callGRPC(address, "/lspaxos.LockServer/Execute", nil, ""); callErr == nil {
+		t.Errorf("gRPC call to a killed replica succeeded\n")
+	}
+}
+
+func Test1c1r1l3aGRPCInvalidCommands(t *testing.T) {
+	numReplicas := 1
+	numLeaders := 1
+	numAcceptors := 3
+
+	acceptorAddresses, acceptors := StartAcceptors(numAcceptors, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	leaderAddresses, leaders := StartLeaders(numLeaders, acceptorAddresses, tcpTransport)
+	_, replicas := StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, tcpTransport)
+	time.Sleep(500 * time.Millisecond)
+	address, serveErr := replicas[0].ServeGRPC("localhost:0")
+	if serveErr != nil {
+		t.Fatalf("Failed to serve gRPC, %s\n", serveErr)
+	}
+
+	// The client ids of the replicas' own commands and of keep alives
+	// are not taken over gRPC
+	for _, clientID := range []int{noopClientID, tickClientID, keepAliveClientID(8)} {
+		if _, _, status := grpcLock(t, address, 1, LockCommand{LockName: "A", LockOp: Lock, ClientID: clientID}, ""); status != "3" {
+			t.Errorf("gRPC lock with reserved client id %d returned status %s\n", clientID, status)
+		}
+	}
+	replicas[0].mu.Lock()
+	if replicas[0].slotOut != 1 || len(replicas[0].clientResults) != 0 {
+		t.Errorf("Invalid gRPC lock was applied up to slot %d, results %+v\n", replicas[0].slotOut, replicas[0].clientResults)
+	}
+	replicas[0].mu.Unlock()
+
+	// The replica still takes valid commands
+	if err, _, status := grpcLock(t, address, 1, LockCommand{LockName: "A", LockOp: Lock, ClientID: 8}, ""); err != OK || status != "0" {
+		t.Errorf("gRPC lock returned %s, status %s\n", err, status)
+	}
+	cleanup(acceptors, leaders, replicas)
+}
+
+// Checks the protobuf encoding against protobuf-go. The golden bytes are
+// what protobuf-go marshals for the same messages, built as dynamicpb
+// messages from lspaxos.proto compiled with protocompile.
+func TestGRPCWireFormat(t *testing.T) {
+	golden := func(encoded string) []byte {
+		data, err := hex.DecodeString(encoded)
+		if err != nil {
+			t.Fatalf("Bad golden bytes %s, %s\n", encoded, err)
+		}
+		return data
+	}
+
+	msgID, lockCommand, err := unmarshalLockRequest(golden("0a170a062f7376632f6112044c6f636b180920dc0b280130011002"))
+	expectedLockCommand := LockCommand{LockName: "/svc/a", LockOp: Lock, ClientID: 9, TTLMillis: 1500, Wait: true, Tree: true}
+	if err != nil || msgID != 2 || lockCommand != expectedLockCommand {
+		t.Errorf("LockRequest decoded as %d %+v, %v\n", msgID, lockCommand, err)
+	}
+
+	result := LockResult{
+		Err:     OK,
+		Token:   42,
+		Holders: []LockHolder{{LockName: "/svc/a", ClientID: 9}, {LockName: "/svc/b", ClientID: 3, Shared: true}},
+	}
+	encodedResponse := golden("0a024f4b1002182a220a0a062f7376632f611009220c0a062f7376632f62100318012a027231")
+	if data := marshalLockResponse(ClientResponse{MsgID: 2, Replicas: []string{"r1"}}, result); !bytes.Equal(data, encodedResponse) {
+		t.Errorf("LockResponse encoded as %x\n", data)
+	}
+
+	// Messages are framed with a compression flag and their length
+	frame := new(bytes.Buffer)
+	if err = writeGRPCMessage(frame, encodedResponse); err != nil {
+		t.Fatalf("Failed to frame a message, %s\n", err)
+	}
+	if !bytes.Equal(frame.Bytes(), append(golden("0000000026"), encodedResponse...)) {
+		t.Errorf("Message framed as %x\n", frame.Bytes())
+	}
+
+	// Status messages are percent-encoded
+	if encoded := encodeGRPCMessage("Lock 100% held\n\u00e9"); encoded != "Lock 100%25 held%0A%C3%A9" {
+		t.Errorf("Status message encoded as %s\n", encoded)
+	}
+}
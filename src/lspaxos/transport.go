@@ -0,0 +1,108 @@
+package lspaxos
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// A Transport carries the RPCs between the roles. Every role is given
+// one when it is started: it serves its handlers through it, and sends
+// its requests through it.
+type Transport interface {
+	// Makes an RPC to the server at Address, and decodes its reply into
+	// Response. Gives up once Ctx is done.
+	Send(Ctx context.Context, Address string, ProcedureName string, Request interface{}, Response interface{}) error
+
+	// Serves the RPC handlers of Receiver (its exported methods, as for
+	// net/rpc) at Address. Returns the address the server is reachable
+	// at, which is picked by the transport if Address is empty.
+	Serve(Address string, Receiver interface{}) (string, error)
+
+	// Stops serving at Address, and cuts off the peers connected to it
+	Close(Address string) error
+}
+
+// Transport that sends gob encoded RPCs over TCP, with net/rpc
+type TCPTransport struct {
+	// Connections to the servers the transport sends to
+	pool *connectionPool
+
+	// Lock to control access to the servers map
+	mu sync.Mutex
+
+	// Servers listening through the transport, keyed by address
+	servers map[string]*tcpServer
+}
+
+// A server listening through a TCPTransport
+type tcpServer struct {
+	listener net.Listener
+
+	// Connections accepted by the listener
+	connections serverConnections
+}
+
+func NewTCPTransport() *TCPTransport {
+	transport := &TCPTransport{servers: make(map[string]*tcpServer)}
+	transport.pool = newConnectionPool(func(ctx context.Context, address string) (*rpc.Client, error) {
+		var dialer net.Dialer
+		connection, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return rpc.NewClient(connection), nil
+	})
+	return transport
+}
+
+func (transport *TCPTransport) Send(Ctx context.Context, Address string, ProcedureName string, Request interface{}, Response interface{}) error {
+	return transport.pool.send(Ctx, Address, ProcedureName, Request, Response)
+}
+
+func (transport *TCPTransport) Serve(Address string, Receiver interface{}) (string, error) {
+	server := rpc.NewServer()
+	if err := server.Register(Receiver); err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", Address)
+	if err != nil {
+		return "", err
+	}
+	tcpServer := &tcpServer{listener: listener}
+	address := listener.Addr().String()
+	transport.mu.Lock()
+	transport.servers[address] = tcpServer
+	transport.mu.Unlock()
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				if !tcpServer.connections.isClosed() {
+					log.Fatalf("Failed to accept connection on %s, %s\n", address, err)
+				}
+				return
+			}
+			go tcpServer.connections.serve(connection, func() { server.ServeConn(connection) })
+		}
+	}()
+	return address, nil
+}
+
+func (transport *TCPTransport) Close(Address string) error {
+	transport.mu.Lock()
+	tcpServer, present := transport.servers[Address]
+	delete(transport.servers, Address)
+	transport.mu.Unlock()
+	if !present {
+		return errors.New("Not serving at " + Address)
+	}
+	// Marks the server closed before the listener, so the accept loop
+	// knows it is not failing
+	tcpServer.connections.close()
+	return tcpServer.listener.Close()
+}
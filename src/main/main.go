@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"lspaxos"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,22 +16,37 @@ const (
 	ip = "localhost:"
 )
 
+// First port of the gRPC endpoints of the replicas, replica i serves on
+// this port plus i. 0 does not serve gRPC.
+var grpcPort = flag.Int("grpc-port", 0, "serve the gRPC endpoint of replica i on this port plus i, and keep serving after the demo")
+
 func main() {
+	flag.Parse()
 	log.SetOutput(ioutil.Discard)
 	lock := "lock"
 
 	numReplicas := 3
 	numLeaders := 3
 	numAcceptors := 3
+	transport := lspaxos.NewTCPTransport()
 
-	acceptorAddresses, _ := lspaxos.StartAcceptors(numAcceptors)
+	acceptorAddresses, _ := lspaxos.StartAcceptors(numAcceptors, transport)
 	time.Sleep(500 * time.Millisecond)
-	leaderAddresses, _ := lspaxos.StartLeaders(numLeaders, acceptorAddresses)
-	replicaAddresses, _ := lspaxos.StartReplicas(numReplicas, leaderAddresses)
+	leaderAddresses, _ := lspaxos.StartLeaders(numLeaders, acceptorAddresses, transport)
+	replicaAddresses, replicas := lspaxos.StartReplicas(numReplicas, acceptorAddresses, leaderAddresses, transport)
 	time.Sleep(500 * time.Millisecond)
+	if *grpcPort > 0 {
+		for i, replica := range replicas {
+			address, err := replica.ServeGRPC(ip + strconv.Itoa(*grpcPort+i))
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("replica %d serves gRPC at %s\n", i, address)
+		}
+	}
 
-	client0 := lspaxos.StartClient(0, replicaAddresses, 100, 50, 2)
-	client1 := lspaxos.StartClient(1, replicaAddresses, 100, 50, 2)
+	client0 := lspaxos.StartClient(0, replicaAddresses, 100, 50, 2, transport)
+	client1 := lspaxos.StartClient(1, replicaAddresses, 100, 50, 2, transport)
 
 	fmt.Println("client0 trying to grab lock")
 	client0.Lock(lock)
@@ -42,26 +59,36 @@ func main() {
 	time.Sleep(5 * time.Second)
 	client0.Unlock(lock)
 	client1.Unlock(lock)
+	if *grpcPort > 0 {
+		// Until interrupted, for gRPC clients
+		select {}
+	}
 }
 
 func test() {
 	AcceptorAddrs := []string{ip + "10000", ip + "10001", ip + "10002"}
 	LeaderAddrs := []string{ip + "20000", ip + "20001"}
 	ReplicaAddrs := []string{ip + "30000"}
+	transport := lspaxos.NewTCPTransport()
 
 	// Start the acceptors
 	for id, addr := range AcceptorAddrs {
-		go lspaxos.StartAcceptor(id, ":"+strings.Split(addr, ":")[1])
+		go lspaxos.StartAcceptor(id, ":"+strings.Split(addr, ":")[1], "", transport)
 	}
 
 	// Start the leaders
 	for id, addr := range LeaderAddrs {
-		go lspaxos.StartLeader(id, AcceptorAddrs, ":"+strings.Split(addr, ":")[1])
+		go lspaxos.StartLeader(id, AcceptorAddrs, ":"+strings.Split(addr, ":")[1], "", transport)
 	}
 
 	// Start the replicas
+	config := lspaxos.Configuration{
+		Acceptors: AcceptorAddrs,
+		Leaders:   LeaderAddrs,
+		Replicas:  ReplicaAddrs,
+	}
 	for id, addr := range ReplicaAddrs {
-		go lspaxos.StartReplica(id, LeaderAddrs, ":"+strings.Split(addr, ":")[1])
+		go lspaxos.StartReplica(id, config, lspaxos.NewLockServer(), ":"+strings.Split(addr, ":")[1], "", transport)
 	}
 	time.Sleep(1 * time.Second)
 
@@ -69,12 +96,12 @@ func test() {
 	Spec := lspaxos.ReadSpec("src/specs/test_spec.txt")
 	wg.Add(2)
 	go func() {
-		lspaxos.StartClientWithSpec(666, ReplicaAddrs, Spec)
+		lspaxos.StartClientWithSpec(666, ReplicaAddrs, Spec, transport)
 		wg.Done()
 	}()
 
 	go func() {
-		lspaxos.StartClientWithSpec(777, ReplicaAddrs, Spec)
+		lspaxos.StartClientWithSpec(777, ReplicaAddrs, Spec, transport)
 		wg.Done()
 	}()
 